@@ -1,8 +1,18 @@
 package encryptedstorage
 
 import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	fage "filippo.io/age"
+	"filippo.io/age/agessh"
 	"github.com/getsops/sops/v3/age"
 	"github.com/getsops/sops/v3/keys"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/caddyserver/caddy/v2"
 )
@@ -15,13 +25,30 @@ func init() {
 // type uses [age](age-encryption.org) key-pair for encryption/decryption.
 // See more: [https://github.com/getsops/sops#encrypting-using-age](https://github.com/getsops/sops#encrypting-using-age)
 type Age struct {
-	// The public key generated by `age`
+	// The public key generated by `age`, or an SSH public key
+	// of type `ssh-ed25519` or `ssh-rsa`
 	Recipient string `json:"recipient,omitempty"`
 
-	// The private keys generated by `age`
+	// More recipients of the data key, each able to decrypt it
+	// independently, e.g. the keys of the team members and a backup key
+	Recipients []string `json:"recipients,omitempty"`
+
+	// The paths of the files holding recipients in the format of `age`
+	// recipients files, i.e. one recipient per line with `#` comments
+	RecipientsFiles []string `json:"recipients_files,omitempty"`
+
+	// The private keys generated by `age`, or PEM-encoded SSH private keys
 	Identities []string `json:"identities,omitempty"`
 
-	mk *age.MasterKey
+	// The paths of the files holding identities, either in the format of
+	// `age` identity files, i.e. one identity per line with `#` comments,
+	// or as a PEM-encoded SSH private key, e.g. `~/.ssh/id_ed25519`
+	IdentityFiles []string `json:"identity_files,omitempty"`
+
+	// The passphrase of the passphrase-protected SSH private keys
+	SSHPassphrase string `json:"ssh_passphrase,omitempty"`
+
+	mks []*age.MasterKey
 }
 
 // Provision implements caddy.Provisioner.
@@ -30,26 +57,111 @@ func (a *Age) Provision(ctx caddy.Context) error {
 	if !ok {
 		r = caddy.NewReplacer()
 	}
-	a.Recipient = r.ReplaceKnown(a.Recipient, "")
-	mk, err := age.MasterKeyFromRecipient(a.Recipient)
+	recipients, err := a.recipients(r)
 	if err != nil {
 		return err
 	}
-	if len(a.Identities) > 0 {
+	a.mks = make([]*age.MasterKey, 0, len(recipients))
+	for _, recipient := range recipients {
+		mk, err := age.MasterKeyFromRecipient(recipient)
+		if err != nil {
+			return err
+		}
+		a.mks = append(a.mks, mk)
+	}
+	if len(a.Identities) > 0 || len(a.IdentityFiles) > 0 {
 		identities := &age.ParsedIdentities{}
+		passphrase := r.ReplaceKnown(a.SSHPassphrase, "")
 		for k, v := range a.Identities {
 			a.Identities[k] = r.ReplaceKnown(v, "")
+			if err := importIdentities(identities, a.Identities[k], passphrase); err != nil {
+				return err
+			}
 		}
-		if err := identities.Import(a.Identities...); err != nil {
-			return err
+		for _, f := range a.IdentityFiles {
+			bs, err := os.ReadFile(r.ReplaceKnown(f, ""))
+			if err != nil {
+				return fmt.Errorf("reading identity file: %v", err)
+			}
+			if err := importIdentities(identities, string(bs), passphrase); err != nil {
+				return fmt.Errorf("identity file %s: %v", f, err)
+			}
+		}
+		for _, mk := range a.mks {
+			identities.ApplyToMasterKey(mk)
 		}
-		identities.ApplyToMasterKey(mk)
 	}
-	a.mk = mk
 
 	return nil
 }
 
+// recipients returns all the configured recipients.
+func (a *Age) recipients(r *caddy.Replacer) ([]string, error) {
+	var recipients []string
+	if a.Recipient = r.ReplaceKnown(a.Recipient, ""); len(a.Recipient) > 0 {
+		recipients = append(recipients, a.Recipient)
+	}
+	for k, v := range a.Recipients {
+		a.Recipients[k] = r.ReplaceKnown(v, "")
+		recipients = append(recipients, a.Recipients[k])
+	}
+	for _, f := range a.RecipientsFiles {
+		bs, err := os.ReadFile(r.ReplaceKnown(f, ""))
+		if err != nil {
+			return nil, fmt.Errorf("reading recipients file: %v", err)
+		}
+		for _, line := range strings.Split(string(bs), "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			recipients = append(recipients, line)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("at least one recipient must be specified")
+	}
+	return recipients, nil
+}
+
+// importIdentities parses the age identities, or the PEM-encoded SSH private key, into ids.
+func importIdentities(ids *age.ParsedIdentities, identities, sshPassphrase string) error {
+	if !strings.Contains(identities, "-----BEGIN") {
+		return ids.Import(identities)
+	}
+	id, err := parseSSHIdentity([]byte(identities), sshPassphrase)
+	if err != nil {
+		return err
+	}
+	*ids = append(*ids, id)
+	return nil
+}
+
+// parseSSHIdentity parses the PEM-encoded SSH private key as an age identity,
+// decrypting it with the passphrase if protected.
+func parseSSHIdentity(pemBytes []byte, passphrase string) (fage.Identity, error) {
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if len(passphrase) == 0 {
+			return nil, errors.New("SSH private key is protected by a passphrase, but none is configured")
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing SSH private key: %v", err)
+	}
+	switch k := key.(type) {
+	case *ed25519.PrivateKey:
+		return agessh.NewEd25519Identity(*k)
+	case ed25519.PrivateKey:
+		return agessh.NewEd25519Identity(k)
+	case *rsa.PrivateKey:
+		return agessh.NewRSAIdentity(k)
+	}
+	return nil, fmt.Errorf("unsupported SSH key type %T", key)
+}
+
 // CaddyModule implements caddy.Module.
 func (a Age) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
@@ -60,13 +172,23 @@ func (a Age) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// ToMasterkey implements Masterkeyer.
+// ToMasterkey implements MasterkeyConverter.
 func (a *Age) ToMasterkey() keys.MasterKey {
-	return a.mk
+	return a.mks[0]
+}
+
+// ToMasterkeys implements MasterkeysConverter.
+func (a *Age) ToMasterkeys() []keys.MasterKey {
+	mks := make([]keys.MasterKey, 0, len(a.mks))
+	for _, mk := range a.mks {
+		mks = append(mks, mk)
+	}
+	return mks
 }
 
 var (
-	_ caddy.Module       = (*Age)(nil)
-	_ caddy.Provisioner  = (*Age)(nil)
-	_ MasterkeyConverter = (*Age)(nil)
+	_ caddy.Module        = (*Age)(nil)
+	_ caddy.Provisioner   = (*Age)(nil)
+	_ MasterkeyConverter  = (*Age)(nil)
+	_ MasterkeysConverter = (*Age)(nil)
 )
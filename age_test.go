@@ -0,0 +1,183 @@
+package encryptedstorage
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeSSHKey writes the OpenSSH private key to a file in the directory, protected by the passphrase
+// if not empty, and returns the file path and the authorized key line of the public key.
+func writeSSHKey(t *testing.T, dir, name string, key crypto.Signer, passphrase string) (string, string) {
+	t.Helper()
+	var (
+		block *pem.Block
+		err   error
+	)
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+func TestStorageWithAgeIdentitySources(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edFile, edRecipient := writeSSHKey(t, dir, "id_ed25519", edKey, "")
+	protectedFile, _ := writeSSHKey(t, dir, "id_ed25519_protected", edKey, "s3cret")
+	rsaFile, rsaRecipient := writeSSHKey(t, dir, "id_rsa", rsaKey, "")
+
+	identityFile := filepath.Join(dir, "keys.txt")
+	identities := fmt.Sprintf("# created: 2024-01-01T00:00:00Z\n# public key: %s\n%s\n\n# public key: %s\n%s\n", recipient2, ageId2, recipient, ageId)
+	if err := os.WriteFile(identityFile, []byte(identities), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_SSH_PASSPHRASE", "s3cret")
+
+	local := func(age string) string {
+		return fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [{"type": "age", %s}]}]}`, age)
+	}
+	testcases := []struct {
+		name  string
+		store string
+		load  string
+		fails bool
+	}{
+		{
+			name:  "age identity file with comments and multiple keys",
+			store: local(fmt.Sprintf(`"recipient": %q`, recipient)),
+			load:  local(fmt.Sprintf(`"recipient": %q, "identity_files": [%q]`, recipient, identityFile)),
+		},
+		{
+			name:  "ssh-ed25519 recipient and identity file",
+			store: local(fmt.Sprintf(`"recipient": %q`, edRecipient)),
+			load:  local(fmt.Sprintf(`"recipient": %q, "identity_files": [%q]`, edRecipient, edFile)),
+		},
+		{
+			name:  "ssh-rsa recipient and identity file",
+			store: local(fmt.Sprintf(`"recipient": %q`, rsaRecipient)),
+			load:  local(fmt.Sprintf(`"recipient": %q, "identity_files": [%q]`, rsaRecipient, rsaFile)),
+		},
+		{
+			name:  "passphrase-protected SSH key with passphrase from placeholder",
+			store: local(fmt.Sprintf(`"recipient": %q`, edRecipient)),
+			load:  local(fmt.Sprintf(`"recipient": %q, "identity_files": [%q], "ssh_passphrase": "{env.TEST_SSH_PASSPHRASE}"`, edRecipient, protectedFile)),
+		},
+		{
+			name:  "passphrase-protected SSH key without passphrase",
+			store: local(fmt.Sprintf(`"recipient": %q, "identity_files": [%q]`, edRecipient, protectedFile)),
+			fails: true,
+		},
+		{
+			name:  "passphrase-protected SSH key with wrong passphrase",
+			store: local(fmt.Sprintf(`"recipient": %q, "identity_files": [%q], "ssh_passphrase": "wrong"`, edRecipient, protectedFile)),
+			fails: true,
+		},
+		{
+			name:  "SSH identity of another recipient",
+			store: local(fmt.Sprintf(`"recipient": %q`, edRecipient)),
+			load:  local(fmt.Sprintf(`"recipient": %q, "identity_files": [%q]`, edRecipient, rsaFile)),
+			fails: true,
+		},
+		{
+			name:  "missing identity file",
+			store: local(fmt.Sprintf(`"recipient": %q, "identity_files": [%q]`, recipient, filepath.Join(dir, "missing.txt"))),
+			fails: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := storeAndLoad(t, t.TempDir(), tc.store, tc.load)
+			if tc.fails && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tc.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStorageWithMultipleAgeRecipients(t *testing.T) {
+	recipientsFile := filepath.Join(t.TempDir(), "recipients.txt")
+	contents := fmt.Sprintf("# team\n%s\n\n# backup\n%s\n", recipient2, recipient3)
+	if err := os.WriteFile(recipientsFile, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	local := func(age string) string {
+		return fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [{"type": "age", %s}]}]}`, age)
+	}
+	testcases := []struct {
+		name  string
+		store string
+		load  string
+		fails bool
+	}{
+		{
+			name:  "first of the recipients",
+			store: local(fmt.Sprintf(`"recipients": [%q, %q, %q]`, recipient, recipient2, recipient3)),
+			load:  local(fmt.Sprintf(`"recipients": [%q, %q, %q], "identities": [%q]`, recipient, recipient2, recipient3, ageId)),
+		},
+		{
+			name:  "last of the recipients",
+			store: local(fmt.Sprintf(`"recipients": [%q, %q, %q]`, recipient, recipient2, recipient3)),
+			load:  local(fmt.Sprintf(`"recipients": [%q, %q, %q], "identities": [%q]`, recipient, recipient2, recipient3, ageId3)),
+		},
+		{
+			name:  "recipient and recipients file",
+			store: local(fmt.Sprintf(`"recipient": %q, "recipients_files": [%q]`, recipient, recipientsFile)),
+			load:  local(fmt.Sprintf(`"recipient": %q, "recipients_files": [%q], "identities": [%q]`, recipient, recipientsFile, ageId2)),
+		},
+		{
+			name:  "identity of none of the recipients",
+			store: local(fmt.Sprintf(`"recipients": [%q, %q]`, recipient, recipient2)),
+			load:  local(fmt.Sprintf(`"recipients": [%q, %q], "identities": [%q]`, recipient, recipient2, ageId3)),
+			fails: true,
+		},
+		{
+			name:  "no recipients",
+			store: local(fmt.Sprintf(`"identities": [%q]`, ageId)),
+			fails: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := storeAndLoad(t, t.TempDir(), tc.store, tc.load)
+			if tc.fails && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tc.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package encryptedstorage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	awskms "github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/getsops/sops/v3/kms"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AWSKMS{})
+}
+
+// kmsARNRegex matches an AWS KMS key or alias ARN, capturing the region. It is the same as used by SOPS.
+var kmsARNRegex = regexp.MustCompile(`^arn:aws[\w-]*:kms:(.+):[0-9]+:(key|alias)/.+$`)
+
+// AWSKMS uses AWS KMS (Key Management Service) for the encryption/decryption.
+// See more: [https://github.com/getsops/sops#encrypting-using-aws-kms](https://github.com/getsops/sops#encrypting-using-aws-kms)
+type AWSKMS struct {
+	// The ARN of the KMS key or alias.
+	ARN string `json:"arn,omitempty"`
+
+	// The ARN of the IAM role to assume through AWS STS for accessing the key.
+	Role string `json:"role,omitempty"`
+
+	// The encryption context bound to the data key. The same context is
+	// required for decryption.
+	EncryptionContext map[string]string `json:"encryption_context,omitempty"`
+
+	// The profile of the shared AWS config and credentials files to use.
+	Profile string `json:"profile,omitempty"`
+
+	// The region of the KMS endpoint. Defaults to the region of the ARN.
+	Region string `json:"region,omitempty"`
+
+	// The ID of the static access key. If not set, the credentials are
+	// obtained from the default AWS credentials chain.
+	AccessKeyID string `json:"access_key_id,omitempty"`
+
+	// The secret of the static access key.
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+
+	// The session token of temporary static credentials.
+	SessionToken string `json:"session_token,omitempty"`
+
+	// The URL of a custom KMS endpoint, e.g. of a local KMS emulator.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	client *awskms.Client
+	mk     *kms.MasterKey
+}
+
+// Provision implements caddy.Provisioner.
+func (a *AWSKMS) Provision(ctx caddy.Context) error {
+	r, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		r = caddy.NewReplacer()
+	}
+	a.ARN = r.ReplaceKnown(a.ARN, "")
+	if len(a.ARN) == 0 {
+		return errors.New("missing arn")
+	}
+	matches := kmsARNRegex.FindStringSubmatch(a.ARN)
+	if matches == nil {
+		return fmt.Errorf("invalid AWS KMS ARN: %s", a.ARN)
+	}
+	a.Region = r.ReplaceKnown(a.Region, "")
+	if len(a.Region) == 0 {
+		a.Region = matches[1]
+	}
+	a.Role = r.ReplaceKnown(a.Role, "")
+	a.Profile = r.ReplaceKnown(a.Profile, "")
+	a.Endpoint = r.ReplaceKnown(a.Endpoint, "")
+
+	opts := []func(*config.LoadOptions) error{config.WithRegion(a.Region)}
+	if len(a.Profile) > 0 {
+		opts = append(opts, config.WithSharedConfigProfile(a.Profile))
+	}
+	accessKeyID, secretAccessKey := r.ReplaceKnown(a.AccessKeyID, ""), r.ReplaceKnown(a.SecretAccessKey, "")
+	if (len(accessKeyID) == 0) != (len(secretAccessKey) == 0) {
+		return errors.New("fields 'access_key_id' and 'secret_access_key' must be specified together")
+	}
+	if len(accessKeyID) > 0 {
+		creds := credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, r.ReplaceKnown(a.SessionToken, ""))
+		opts = append(opts, config.WithCredentialsProvider(creds))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("loading AWS config: %v", err)
+	}
+	if len(a.Role) > 0 {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), a.Role))
+	}
+	a.client = awskms.NewFromConfig(cfg, func(o *awskms.Options) {
+		if len(a.Endpoint) > 0 {
+			o.BaseEndpoint = aws.String(a.Endpoint)
+		}
+	})
+
+	var encCtx map[string]*string
+	if len(a.EncryptionContext) > 0 {
+		encCtx = make(map[string]*string, len(a.EncryptionContext))
+		for k, v := range a.EncryptionContext {
+			v := r.ReplaceKnown(v, "")
+			a.EncryptionContext[k] = v
+			encCtx[k] = &v
+		}
+	}
+	a.mk = kms.NewMasterKeyWithProfile(a.ARN, a.Role, encCtx, a.Profile)
+	return nil
+}
+
+// matches implements keyCrypter.
+func (a *AWSKMS) matches(key *keyservice.Key) bool {
+	k, ok := key.GetKeyType().(*keyservice.Key_KmsKey)
+	return ok && k.KmsKey.Arn == a.ARN
+}
+
+// encrypt implements keyCrypter. The ciphertext is base64-encoded as done by SOPS.
+func (a *AWSKMS) encrypt(dataKey []byte) ([]byte, error) {
+	out, err := a.client.Encrypt(context.Background(), &awskms.EncryptInput{
+		KeyId:             aws.String(a.ARN),
+		Plaintext:         dataKey,
+		EncryptionContext: a.EncryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data key with AWS KMS: %w", err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(out.CiphertextBlob)), nil
+}
+
+// decrypt implements keyCrypter.
+func (a *AWSKMS) decrypt(ciphertext []byte) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(string(ciphertext))
+	if err != nil {
+		return nil, fmt.Errorf("error base64-decoding encrypted data key: %v", err)
+	}
+	out, err := a.client.Decrypt(context.Background(), &awskms.DecryptInput{
+		KeyId:             aws.String(a.ARN),
+		CiphertextBlob:    blob,
+		EncryptionContext: a.EncryptionContext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key with AWS KMS: %w", err)
+	}
+	return out.Plaintext, nil
+}
+
+// CaddyModule implements caddy.Module.
+func (AWSKMS) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.storage.encrypted.key.aws_kms",
+		New: func() caddy.Module {
+			return new(AWSKMS)
+		},
+	}
+}
+
+// ToMasterkey implements MasterkeyConverter.
+func (a *AWSKMS) ToMasterkey() keys.MasterKey {
+	return a.mk
+}
+
+var (
+	_ caddy.Module       = (*AWSKMS)(nil)
+	_ caddy.Provisioner  = (*AWSKMS)(nil)
+	_ MasterkeyConverter = (*AWSKMS)(nil)
+	_ keyCrypter         = (*AWSKMS)(nil)
+)
@@ -0,0 +1,120 @@
+package encryptedstorage
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeKMS is a minimal AWS KMS emulator serving the Encrypt and Decrypt actions.
+type fakeKMS struct {
+	mu   sync.Mutex
+	keys map[string]fakeKMSEntry
+}
+
+type fakeKMSEntry struct {
+	keyID     string
+	context   map[string]string
+	plaintext []byte
+}
+
+type fakeKMSRequest struct {
+	KeyId             string
+	Plaintext         []byte
+	CiphertextBlob    []byte
+	EncryptionContext map[string]string
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req fakeKMSRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.Encrypt":
+		blob := make([]byte, 32)
+		rand.Read(blob)
+		f.keys[string(blob)] = fakeKMSEntry{keyID: req.KeyId, context: req.EncryptionContext, plaintext: req.Plaintext}
+		json.NewEncoder(w).Encode(map[string]any{"CiphertextBlob": blob, "KeyId": req.KeyId})
+	case "TrentService.Decrypt":
+		entry, ok := f.keys[string(req.CiphertextBlob)]
+		if !ok || entry.keyID != req.KeyId || !maps.Equal(entry.context, req.EncryptionContext) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "InvalidCiphertextException", "message": "invalid ciphertext"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"Plaintext": entry.plaintext, "KeyId": req.KeyId})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"__type": "UnsupportedOperationException", "message": "unsupported"})
+	}
+}
+
+func TestStorageWithAWSKMSEncryption(t *testing.T) {
+	srv := httptest.NewServer(&fakeKMS{keys: make(map[string]fakeKMSEntry)})
+	t.Cleanup(srv.Close)
+	t.Setenv("TEST_AWS_SECRET_ACCESS_KEY", "secret")
+
+	const arn = "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+	local := func(fields string) string {
+		return fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [{"type": "aws_kms", "endpoint": %q, %s}]}]}`, srv.URL, fields)
+	}
+	testcases := []struct {
+		name  string
+		store string
+		load  string
+		fails bool
+	}{
+		{
+			name:  "static credentials",
+			store: local(fmt.Sprintf(`"arn": %q, "access_key_id": "AKID", "secret_access_key": "secret"`, arn)),
+			load:  local(fmt.Sprintf(`"arn": %q, "access_key_id": "AKID", "secret_access_key": "secret"`, arn)),
+		},
+		{
+			name:  "credentials from placeholder",
+			store: local(fmt.Sprintf(`"arn": %q, "region": "eu-west-1", "access_key_id": "AKID", "secret_access_key": "{env.TEST_AWS_SECRET_ACCESS_KEY}"`, arn)),
+			load:  local(fmt.Sprintf(`"arn": %q, "region": "eu-west-1", "access_key_id": "AKID", "secret_access_key": "{env.TEST_AWS_SECRET_ACCESS_KEY}"`, arn)),
+		},
+		{
+			name:  "encryption context",
+			store: local(fmt.Sprintf(`"arn": %q, "encryption_context": {"app": "caddy"}, "access_key_id": "AKID", "secret_access_key": "secret"`, arn)),
+			load:  local(fmt.Sprintf(`"arn": %q, "encryption_context": {"app": "caddy"}, "access_key_id": "AKID", "secret_access_key": "secret"`, arn)),
+		},
+		{
+			name:  "encryption context mismatch",
+			store: local(fmt.Sprintf(`"arn": %q, "encryption_context": {"app": "caddy"}, "access_key_id": "AKID", "secret_access_key": "secret"`, arn)),
+			load:  local(fmt.Sprintf(`"arn": %q, "encryption_context": {"app": "other"}, "access_key_id": "AKID", "secret_access_key": "secret"`, arn)),
+			fails: true,
+		},
+		{
+			name:  "invalid ARN",
+			store: local(`"arn": "not-an-arn", "access_key_id": "AKID", "secret_access_key": "secret"`),
+			fails: true,
+		},
+		{
+			name:  "access key without secret",
+			store: local(fmt.Sprintf(`"arn": %q, "access_key_id": "AKID"`, arn)),
+			fails: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := storeAndLoad(t, t.TempDir(), tc.store, tc.load)
+			if tc.fails && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tc.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package encryptedstorage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azkeys"
+	"github.com/getsops/sops/v3/azkv"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/keyservice"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AzureKeyVault{})
+}
+
+// AzureKeyVault uses a key of Azure Key Vault for the encryption/decryption. If neither client
+// credentials nor managed identity are configured, the default Azure credentials chain is used.
+// See more: [https://github.com/getsops/sops#encrypting-using-azure-key-vault](https://github.com/getsops/sops#encrypting-using-azure-key-vault)
+type AzureKeyVault struct {
+	// The URL of the vault, e.g. `https://my-vault.vault.azure.net`.
+	VaultURL string `json:"vault_url,omitempty"`
+
+	// The name of the key.
+	KeyName string `json:"key_name,omitempty"`
+
+	// The version of the key. It is required so that the data remains
+	// decryptable after the key is rotated.
+	Version string `json:"version,omitempty"`
+
+	// The Microsoft Entra tenant ID of the service principal.
+	TenantID string `json:"tenant_id,omitempty"`
+
+	// The client ID of the service principal, or of the user-assigned
+	// managed identity.
+	ClientID string `json:"client_id,omitempty"`
+
+	// The client secret of the service principal.
+	ClientSecret string `json:"client_secret,omitempty"`
+
+	// The path of the PEM or PKCS#12 file holding the client certificate
+	// and its private key of the service principal.
+	ClientCertificateFile string `json:"client_certificate_file,omitempty"`
+
+	// Authenticate with the managed identity of the host. The identity is
+	// the system-assigned one, unless `client_id` is set.
+	ManagedIdentity bool `json:"managed_identity,omitempty"`
+
+	// The Microsoft Entra authority host, for national or private clouds.
+	// Defaults to the Azure public cloud.
+	AuthorityHost string `json:"authority_host,omitempty"`
+
+	client *azkeys.Client
+	mk     *azkv.MasterKey
+
+	// transport overrides the HTTP transport of the Azure clients. It is only set in tests.
+	transport policy.Transporter
+}
+
+// Provision implements caddy.Provisioner.
+func (a *AzureKeyVault) Provision(ctx caddy.Context) error {
+	r, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		r = caddy.NewReplacer()
+	}
+	a.VaultURL = r.ReplaceKnown(a.VaultURL, "")
+	a.KeyName = r.ReplaceKnown(a.KeyName, "")
+	a.Version = r.ReplaceKnown(a.Version, "")
+	if len(a.VaultURL) == 0 {
+		return errors.New("missing vault_url")
+	}
+	if len(a.KeyName) == 0 {
+		return errors.New("missing key_name")
+	}
+	if len(a.Version) == 0 {
+		return errors.New("missing version")
+	}
+
+	clientOpts := azcore.ClientOptions{Transport: a.transport}
+	if host := r.ReplaceKnown(a.AuthorityHost, ""); len(host) > 0 {
+		clientOpts.Cloud = cloud.Configuration{ActiveDirectoryAuthorityHost: host}
+	}
+	cred, err := a.credential(r, clientOpts)
+	if err != nil {
+		return err
+	}
+	a.client, err = azkeys.NewClient(a.VaultURL, cred, &azkeys.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: a.transport}})
+	if err != nil {
+		return fmt.Errorf("creating Azure Key Vault client: %v", err)
+	}
+	a.mk = azkv.NewMasterKey(a.VaultURL, a.KeyName, a.Version)
+	return nil
+}
+
+// credential returns the token credential of the configured authentication method.
+func (a *AzureKeyVault) credential(r *caddy.Replacer, opts azcore.ClientOptions) (azcore.TokenCredential, error) {
+	tenantID, clientID := r.ReplaceKnown(a.TenantID, ""), r.ReplaceKnown(a.ClientID, "")
+	clientSecret, certFile := r.ReplaceKnown(a.ClientSecret, ""), r.ReplaceKnown(a.ClientCertificateFile, "")
+	// instance discovery validates the authority against the Azure public cloud
+	disableDiscovery := len(opts.Cloud.ActiveDirectoryAuthorityHost) > 0
+	switch {
+	case len(clientSecret) > 0 && len(certFile) > 0:
+		return nil, errors.New("fields 'client_secret' and 'client_certificate_file' are mutually exclusive")
+	case a.ManagedIdentity && (len(clientSecret) > 0 || len(certFile) > 0):
+		return nil, errors.New("managed identity cannot be used with client credentials")
+	case a.ManagedIdentity:
+		miOpts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: opts}
+		if len(clientID) > 0 {
+			miOpts.ID = azidentity.ClientID(clientID)
+		}
+		return azidentity.NewManagedIdentityCredential(miOpts)
+	case len(clientSecret) > 0 || len(certFile) > 0:
+		if len(tenantID) == 0 || len(clientID) == 0 {
+			return nil, errors.New("fields 'tenant_id' and 'client_id' are required for client credentials")
+		}
+		if len(clientSecret) > 0 {
+			return azidentity.NewClientSecretCredential(tenantID, clientID, clientSecret, &azidentity.ClientSecretCredentialOptions{
+				ClientOptions:            opts,
+				DisableInstanceDiscovery: disableDiscovery,
+			})
+		}
+		bs, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client certificate: %v", err)
+		}
+		certs, key, err := azidentity.ParseCertificates(bs, nil)
+		if err != nil {
+			return nil, fmt.Errorf("parsing client certificate: %v", err)
+		}
+		return azidentity.NewClientCertificateCredential(tenantID, clientID, certs, key, &azidentity.ClientCertificateCredentialOptions{
+			ClientOptions:            opts,
+			DisableInstanceDiscovery: disableDiscovery,
+		})
+	}
+	return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+		ClientOptions:            opts,
+		TenantID:                 tenantID,
+		DisableInstanceDiscovery: disableDiscovery,
+	})
+}
+
+// matches implements keyCrypter.
+func (a *AzureKeyVault) matches(key *keyservice.Key) bool {
+	k, ok := key.GetKeyType().(*keyservice.Key_AzureKeyvaultKey)
+	return ok && k.AzureKeyvaultKey.VaultUrl == a.VaultURL &&
+		k.AzureKeyvaultKey.Name == a.KeyName &&
+		k.AzureKeyvaultKey.Version == a.Version
+}
+
+// encrypt implements keyCrypter. The ciphertext is base64-encoded as done by SOPS.
+func (a *AzureKeyVault) encrypt(dataKey []byte) ([]byte, error) {
+	resp, err := a.client.Encrypt(context.Background(), a.KeyName, a.Version, azkeys.KeyOperationParameters{
+		Algorithm: to.Ptr(azkeys.EncryptionAlgorithmRSAOAEP256),
+		Value:     dataKey,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data key with Azure Key Vault key '%s': %w", a.mk.ToString(), err)
+	}
+	return []byte(base64.RawURLEncoding.EncodeToString(resp.Result)), nil
+}
+
+// decrypt implements keyCrypter.
+func (a *AzureKeyVault) decrypt(ciphertext []byte) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(string(ciphertext))
+	if err != nil {
+		return nil, fmt.Errorf("error base64-decoding encrypted data key: %v", err)
+	}
+	resp, err := a.client.Decrypt(context.Background(), a.KeyName, a.Version, azkeys.KeyOperationParameters{
+		Algorithm: to.Ptr(azkeys.EncryptionAlgorithmRSAOAEP256),
+		Value:     raw,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key with Azure Key Vault key '%s': %w", a.mk.ToString(), err)
+	}
+	return resp.Result, nil
+}
+
+// CaddyModule implements caddy.Module.
+func (AzureKeyVault) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.storage.encrypted.key.azure_kv",
+		New: func() caddy.Module {
+			return new(AzureKeyVault)
+		},
+	}
+}
+
+// ToMasterkey implements MasterkeyConverter.
+func (a *AzureKeyVault) ToMasterkey() keys.MasterKey {
+	return a.mk
+}
+
+var (
+	_ caddy.Module       = (*AzureKeyVault)(nil)
+	_ caddy.Provisioner  = (*AzureKeyVault)(nil)
+	_ MasterkeyConverter = (*AzureKeyVault)(nil)
+	_ keyCrypter         = (*AzureKeyVault)(nil)
+)
@@ -0,0 +1,170 @@
+package encryptedstorage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const (
+	azureTenantID  = "00000000-0000-0000-0000-000000000001"
+	azureAuthority = "https://login.example.com/"
+	azureVaultURL  = "https://caddy.vault.azure.net"
+)
+
+// fakeAzure is a minimal emulator of the Microsoft Entra token endpoint and the
+// Key Vault encrypt and decrypt operations.
+type fakeAzure struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	tenantPath := "/" + azureTenantID
+	switch {
+	case r.URL.Path == tenantPath+"/v2.0/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]string{
+			"authorization_endpoint": azureAuthority + azureTenantID + "/oauth2/v2.0/authorize",
+			"token_endpoint":         azureAuthority + azureTenantID + "/oauth2/v2.0/token",
+			"issuer":                 azureAuthority + azureTenantID + "/v2.0",
+		})
+	case r.URL.Path == tenantPath+"/oauth2/v2.0/token":
+		r.ParseForm()
+		if r.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "token", "token_type": "Bearer", "expires_in": 3600})
+	case strings.HasPrefix(r.URL.Path, "/keys/caddy/v1/"):
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer authorization="%s%s", resource="https://vault.azure.net"`, azureAuthority, azureTenantID))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Value string `json:"value"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		value, _ := base64.RawURLEncoding.DecodeString(req.Value)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var result []byte
+		switch strings.TrimPrefix(r.URL.Path, "/keys/caddy/v1/") {
+		case "encrypt":
+			result = make([]byte, 32)
+			rand.Read(result)
+			f.values[string(result)] = value
+		case "decrypt":
+			var ok bool
+			if result, ok = f.values[string(value)]; !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": "BadParameter", "message": "invalid ciphertext"}})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"kid":   azureVaultURL + "/keys/caddy/v1",
+			"value": base64.RawURLEncoding.EncodeToString(result),
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": "KeyNotFound", "message": "not found"}})
+	}
+}
+
+func TestStorageWithAzureKeyVaultEncryption(t *testing.T) {
+	srv := httptest.NewTLSServer(&fakeAzure{values: make(map[string][]byte)})
+	t.Cleanup(srv.Close)
+	// every host, i.e. the vault and the authority, resolves to the fake server
+	transport := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, network, srv.Listener.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	t.Setenv("TEST_AZURE_CLIENT_SECRET", "secret")
+
+	newKey := func(version, clientSecret string, managedIdentity bool) *AzureKeyVault {
+		return &AzureKeyVault{
+			VaultURL:        azureVaultURL,
+			KeyName:         "caddy",
+			Version:         version,
+			AuthorityHost:   azureAuthority,
+			TenantID:        azureTenantID,
+			ClientID:        "caddy",
+			ClientSecret:    clientSecret,
+			ManagedIdentity: managedIdentity,
+			transport:       transport,
+		}
+	}
+	testcases := []struct {
+		name  string
+		key   *AzureKeyVault
+		fails bool
+	}{
+		{
+			name: "client secret",
+			key:  newKey("v1", "secret", false),
+		},
+		{
+			name: "client secret from placeholder",
+			key:  newKey("v1", "{env.TEST_AZURE_CLIENT_SECRET}", false),
+		},
+		{
+			name:  "wrong client secret",
+			key:   newKey("v1", "wrong", false),
+			fails: true,
+		},
+		{
+			name:  "unknown key version",
+			key:   newKey("v2", "secret", false),
+			fails: true,
+		},
+		{
+			name:  "missing version",
+			key:   newKey("", "secret", false),
+			fails: true,
+		},
+		{
+			name:  "managed identity with client secret",
+			key:   newKey("v1", "secret", true),
+			fails: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			err := tc.key.Provision(ctx)
+			if err == nil {
+				var ciphertext, plaintext []byte
+				if ciphertext, err = tc.key.encrypt([]byte(val)); err == nil {
+					if plaintext, err = tc.key.decrypt(ciphertext); err == nil && string(plaintext) != val {
+						t.Fatalf("data mismatch: %s != %s", plaintext, val)
+					}
+				}
+			}
+			if tc.fails && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tc.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -2,12 +2,18 @@ package encryptedstorage
 
 import (
 	"encoding/json"
+	"strconv"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 )
 
+func init() {
+	httpcaddyfile.RegisterGlobalOption("sops_keyservice", parseKeyServiceOption)
+}
+
 func (s *Storage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	if !d.Next() {
 		return d.ArgErr()
@@ -36,16 +42,68 @@ func (s *Storage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			s.RawBackend = caddyconfig.JSONModuleObject(backend, "module", name, nil)
 		case "provider":
+			provider, err := unmarshalProvider(d)
+			if err != nil {
+				return err
+			}
+			s.Encryption = append(s.Encryption, provider)
+		case "shamir_threshold":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			name := d.Val()
-			modID := "caddy.storage.encrypted.provider." + name
-			unm, err := caddyfile.UnmarshalModule(d, modID)
+			threshold, err := strconv.Atoi(d.Val())
 			if err != nil {
+				return d.Errf("bad threshold '%s': %v", d.Val(), err)
+			}
+			s.ShamirThreshold = threshold
+		case "reencrypt_on_load":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			s.ReencryptOnLoad = true
+		case "format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Format = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "cipher":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Cipher = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "require_bound_data":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			s.RequireBoundData = true
+		case "obfuscate_names":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.ObfuscateNames = &NameObfuscation{Secret: d.Val()}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "migrate_plaintext":
+			if s.MigratePlaintext != nil {
+				return d.Err("plaintext migration already specified")
+			}
+			s.MigratePlaintext = &PlaintextMigration{PathPrefixes: d.RemainingArgs()}
+		case "policy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p := &Policy{Action: d.Val(), Paths: d.RemainingArgs()}
+			if err := p.unmarshalCaddyfile(d); err != nil {
 				return err
 			}
-			s.Encryption = append(s.Encryption, caddyconfig.JSONModuleObject(unm, "provider", name, nil))
+			s.Policies = append(s.Policies, p)
 		default:
 			return d.Errf("unrecognized parameter '%s'", d.Val())
 		}
@@ -63,20 +121,310 @@ func (s *Local) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		switch d.Val() {
 		case "key":
+			k, err := unmarshalKey(d)
+			if err != nil {
+				return err
+			}
+			s.Keys = append(s.Keys, k)
+		case "key_group":
+			kg, err := unmarshalKeyGroup(d)
+			if err != nil {
+				return err
+			}
+			s.KeyGroups = append(s.KeyGroups, kg)
+		case "legacy_key":
+			k, err := unmarshalKey(d)
+			if err != nil {
+				return err
+			}
+			s.LegacyKeys = append(s.LegacyKeys, k)
+		default:
+			return d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+func (s *Remote) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if len(s.Address) > 0 {
+				return d.Err("address already specified")
+			}
+			s.Address = d.Val()
+		case "insecure":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Insecure = true
+		case "dial_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("bad timeout value '%s': %v", d.Val(), err)
+			}
+			s.DialTimeout = caddy.Duration(dur)
+		case "peer_uid":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
+			uid, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("bad user ID '%s': %v", d.Val(), err)
+			}
+			s.PeerUID = &uid
+		case "tls":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			if s.TLS != nil {
+				return d.Err("tls already specified")
+			}
+			s.TLS = new(RemoteTLS)
+			if err := s.TLS.unmarshalCaddyfile(d); err != nil {
+				return err
+			}
+		case "key":
+			k, err := unmarshalKey(d)
+			if err != nil {
+				return err
+			}
+			s.Keys = append(s.Keys, k)
+		case "key_group":
+			kg, err := unmarshalKeyGroup(d)
+			if err != nil {
+				return err
+			}
+			s.KeyGroups = append(s.KeyGroups, kg)
+		case "legacy_key":
+			k, err := unmarshalKey(d)
+			if err != nil {
+				return err
+			}
+			s.LegacyKeys = append(s.LegacyKeys, k)
+		default:
+			return d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalProvider sets up the encryption provider module of the `provider <name>` directive at the current position of the dispenser.
+func unmarshalProvider(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	modID := "caddy.storage.encrypted.provider." + name
+	unm, err := caddyfile.UnmarshalModule(d, modID)
+	if err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(unm, "provider", name, nil), nil
+}
+
+// unmarshalCaddyfile sets up the Policy from the Caddyfile block at the current nesting of the dispenser.
+//
+//	policy <action> [<paths...>] {
+//		path_regexp <regexp>
+//		shamir_threshold <threshold>
+//		provider <name> ...
+//		tenant <template> {
+//			<name> {
+//				shamir_threshold <threshold>
+//				provider <name> ...
+//			}
+//		}
+//	}
+func (p *Policy) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "tenant":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if p.Tenant != "" {
+				return d.Err("tenant already specified")
+			}
+			p.Tenant = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			p.Tenants = make(map[string]*Tenant)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				name := d.Val()
+				if _, ok := p.Tenants[name]; ok {
+					return d.Errf("tenant '%s' already specified", name)
+				}
+				t := new(Tenant)
+				if err := t.unmarshalCaddyfile(d); err != nil {
+					return err
+				}
+				p.Tenants[name] = t
+			}
+		case "path_regexp":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if p.PathRegexp != "" {
+				return d.Err("path_regexp already specified")
+			}
+			p.PathRegexp = d.Val()
+		case "shamir_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			threshold, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("bad threshold '%s': %v", d.Val(), err)
+			}
+			p.ShamirThreshold = threshold
+		case "provider":
+			provider, err := unmarshalProvider(d)
+			if err != nil {
+				return err
+			}
+			p.Encryption = append(p.Encryption, provider)
+		default:
+			return d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfile sets up the Tenant from the Caddyfile block at the current nesting of the dispenser.
+//
+//	<name> {
+//		shamir_threshold <threshold>
+//		provider <name> ...
+//	}
+func (t *Tenant) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "shamir_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			threshold, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("bad threshold '%s': %v", d.Val(), err)
+			}
+			t.ShamirThreshold = threshold
+		case "provider":
+			provider, err := unmarshalProvider(d)
+			if err != nil {
+				return err
+			}
+			t.Encryption = append(t.Encryption, provider)
+		default:
+			return d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// unmarshalKey sets up the key module of the `key <type>` directive at the current position of the dispenser.
+func unmarshalKey(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	modID := "caddy.storage.encrypted.key." + name
+	unm, err := caddyfile.UnmarshalModule(d, modID)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := unm.(MasterkeyConverter)
+	if !ok {
+		return nil, d.Errf("module %s (%T) is not a supported key type (requires MasterkeyConverter)", modID, unm)
+	}
+	return caddyconfig.JSONModuleObject(k, "type", name, nil), nil
+}
+
+// unmarshalKeyGroup sets up the keys of the `key_group` block at the current position of the dispenser.
+//
+//	key_group {
+//		key <type> ...
+//	}
+func unmarshalKeyGroup(d *caddyfile.Dispenser) ([]json.RawMessage, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	var group []json.RawMessage
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "key":
+			k, err := unmarshalKey(d)
+			if err != nil {
+				return nil, err
+			}
+			group = append(group, k)
+		default:
+			return nil, d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	if len(group) == 0 {
+		return nil, d.Err("key_group cannot be empty")
+	}
+	return group, nil
+}
+
+// unmarshalCaddyfile sets up the RemoteTLS from the Caddyfile block at the current nesting of the dispenser.
+//
+//	tls {
+//		ca <module> ...
+//		client_certificate <cert_file> <key_file>
+//		client_certificate_name <name>
+//		server_name <name>
+//	}
+func (t *RemoteTLS) unmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "ca":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if t.CARaw != nil {
+				return d.Err("ca already specified")
+			}
 			name := d.Val()
-			modID := "caddy.storage.encrypted.key." + name
+			modID := "tls.ca_pool.source." + name
 			unm, err := caddyfile.UnmarshalModule(d, modID)
 			if err != nil {
 				return err
 			}
-			k, ok := unm.(MasterkeyConverter)
-			if !ok {
-				return d.Errf("module %s (%T) is not a supported storage implementation (requires caddy.StorageConvertor)", modID, unm)
+			t.CARaw = caddyconfig.JSONModuleObject(unm, "provider", name, nil)
+		case "client_certificate":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			t.ClientCertificateFile, t.ClientCertificateKeyFile = args[0], args[1]
+		case "client_certificate_name":
+			if !d.NextArg() {
+				return d.ArgErr()
 			}
-			s.Keys = append(s.Keys, caddyconfig.JSONModuleObject(k, "type", name, nil))
+			t.ClientCertificateName = d.Val()
+		case "server_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			t.ServerName = d.Val()
 		default:
 			return d.Errf("unrecognized parameter '%s'", d.Val())
 		}
@@ -101,11 +449,32 @@ func (s *Age) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Err("recipient already specified")
 			}
 			s.Recipient = d.Val()
+		case "recipients":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			s.Recipients = append(s.Recipients, args...)
+		case "recipients_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.RecipientsFiles = append(s.RecipientsFiles, d.Val())
 		case "identity":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
 			s.Identities = append(s.Identities, d.Val())
+		case "identity_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.IdentityFiles = append(s.IdentityFiles, d.Val())
+		case "ssh_passphrase":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.SSHPassphrase = d.Val()
 		default:
 			return d.Errf("unrecognized parameter '%s'", d.Val())
 		}
@@ -141,3 +510,376 @@ func (s *GCPKMS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	}
 	return nil
 }
+
+func (p *PGP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "fingerprint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if len(p.Fingerprint) > 0 {
+				return d.Err("fingerprint already specified")
+			}
+			p.Fingerprint = d.Val()
+		case "public_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.PublicKey = d.Val()
+		case "public_key_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.PublicKeyFile = d.Val()
+		case "private_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.PrivateKey = d.Val()
+		case "private_key_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.PrivateKeyFile = d.Val()
+		case "passphrase":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			p.Passphrase = d.Val()
+		default:
+			return d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+func (a *AWSKMS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "arn":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if len(a.ARN) > 0 {
+				return d.Err("arn already specified")
+			}
+			a.ARN = d.Val()
+		case "role":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Role = d.Val()
+		case "encryption_context":
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return d.ArgErr()
+			}
+			if a.EncryptionContext == nil {
+				a.EncryptionContext = make(map[string]string)
+			}
+			a.EncryptionContext[args[0]] = args[1]
+		case "profile":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Profile = d.Val()
+		case "region":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Region = d.Val()
+		case "credentials":
+			args := d.RemainingArgs()
+			if len(args) != 2 && len(args) != 3 {
+				return d.ArgErr()
+			}
+			a.AccessKeyID, a.SecretAccessKey = args[0], args[1]
+			if len(args) == 3 {
+				a.SessionToken = args[2]
+			}
+		case "endpoint":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Endpoint = d.Val()
+		default:
+			return d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+func (a *AzureKeyVault) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "vault_url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if len(a.VaultURL) > 0 {
+				return d.Err("vault_url already specified")
+			}
+			a.VaultURL = d.Val()
+		case "key_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.KeyName = d.Val()
+		case "version":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.Version = d.Val()
+		case "tenant_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.TenantID = d.Val()
+		case "client_id":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.ClientID = d.Val()
+		case "client_secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.ClientSecret = d.Val()
+		case "client_certificate_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.ClientCertificateFile = d.Val()
+		case "managed_identity":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			a.ManagedIdentity = true
+		case "authority_host":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			a.AuthorityHost = d.Val()
+		default:
+			return d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+func (v *HashiCorpVault) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if !d.Next() {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			if len(v.Address) > 0 {
+				return d.Err("address already specified")
+			}
+			v.Address = d.Val()
+		case "engine_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v.EnginePath = d.Val()
+		case "key_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v.KeyName = d.Val()
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v.Token = d.Val()
+		case "approle":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			v.AppRole = new(VaultAppRoleAuth)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "role_id":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v.AppRole.RoleID = d.Val()
+				case "secret_id":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v.AppRole.SecretID = d.Val()
+				case "mount_path":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v.AppRole.MountPath = d.Val()
+				default:
+					return d.Errf("unrecognized parameter '%s'", d.Val())
+				}
+			}
+		case "kubernetes":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			v.Kubernetes = new(VaultKubernetesAuth)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "role":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v.Kubernetes.Role = d.Val()
+				case "token_file":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v.Kubernetes.TokenFile = d.Val()
+				case "mount_path":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v.Kubernetes.MountPath = d.Val()
+				default:
+					return d.Errf("unrecognized parameter '%s'", d.Val())
+				}
+			}
+		case "namespace":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v.Namespace = d.Val()
+		case "ca_cert":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v.CACert = d.Val()
+		case "ca_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v.CAPath = d.Val()
+		case "tls_server_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v.TLSServerName = d.Val()
+		default:
+			return d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseKeyServiceOption sets up the `sops_keyservice` app from the global option of the same name.
+//
+//	sops_keyservice {
+//		listen <address>...
+//		insecure
+//		tls {
+//			certificate <cert_file> <key_file>
+//			client_ca <module> ...
+//		}
+//		provider <module> ...
+//	}
+func parseKeyServiceOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	ks := new(KeyService)
+	if !d.Next() {
+		return nil, d.ArgErr()
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "listen":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			ks.Listen = append(ks.Listen, args...)
+		case "insecure":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			ks.Insecure = true
+		case "tls":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if ks.TLS != nil {
+				return nil, d.Err("tls already specified")
+			}
+			ks.TLS = new(KeyServiceTLS)
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "certificate":
+					args := d.RemainingArgs()
+					if len(args) != 2 {
+						return nil, d.ArgErr()
+					}
+					ks.TLS.CertificateFile, ks.TLS.CertificateKeyFile = args[0], args[1]
+				case "client_ca":
+					if !d.NextArg() {
+						return nil, d.ArgErr()
+					}
+					name := d.Val()
+					modID := "tls.ca_pool.source." + name
+					unm, err := caddyfile.UnmarshalModule(d, modID)
+					if err != nil {
+						return nil, err
+					}
+					ks.TLS.ClientCARaw = caddyconfig.JSONModuleObject(unm, "provider", name, nil)
+				default:
+					return nil, d.Errf("unrecognized parameter '%s'", d.Val())
+				}
+			}
+		case "provider":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if ks.ProviderRaw != nil {
+				return nil, d.Err("provider already specified")
+			}
+			name := d.Val()
+			modID := "caddy.storage.encrypted.provider." + name
+			unm, err := caddyfile.UnmarshalModule(d, modID)
+			if err != nil {
+				return nil, err
+			}
+			ks.ProviderRaw = caddyconfig.JSONModuleObject(unm, "provider", name, nil)
+		default:
+			return nil, d.Errf("unrecognized parameter '%s'", d.Val())
+		}
+	}
+	return httpcaddyfile.App{
+		Name:  "sops_keyservice",
+		Value: caddyconfig.JSON(ks, nil),
+	}, nil
+}
@@ -0,0 +1,365 @@
+package encryptedstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/spf13/cobra"
+
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "sops-keyservice",
+		Usage: "[--config <path> [--adapter <name>]]",
+		Short: "Serves an encryption provider as a SOPS key service",
+		Long: `
+Runs only the 'sops_keyservice' app of the given config, serving the configured
+encryption provider (e.g. 'local') as a SOPS key service over gRPC. The 'remote'
+encryption provider of the 'encrypted' storage can then be pointed at it, so only
+the host running the key service holds the credentials of the keys.
+
+The rest of the config, e.g. the HTTP servers, is ignored and the admin endpoint
+is disabled. The config is loaded the same way as 'caddy run' does.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("config", "c", "", "Configuration file")
+			cmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdSopsKeyService)
+		},
+	})
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "encrypted-storage",
+		Short: "Manages the data of the 'encrypted' storage",
+		Long: `
+Manages the data persisted in the 'encrypted' storage configured in the given
+config, loaded the same way as 'caddy run' does.
+`,
+		CobraFunc: func(cmd *cobra.Command) {
+			rotate := &cobra.Command{
+				Use:   "rotate [--config <path> [--adapter <name>]] [--dry-run] [--concurrency <n>] [--progress <path>]",
+				Short: "Re-encrypts the stored data with the current keys",
+				Long: `
+Walks the backend of the 'encrypted' storage, decrypts each stored object and
+encrypts it again with a new data key under the current key groups, e.g. after
+moving the retired keys to 'legacy_keys' of the provider, i.e. 'legacy_key' in
+the Caddyfile. Each object is rewritten while holding its storage lock, so the
+rotation can run while Caddy is serving.
+
+With --dry-run, the objects are only decrypted and reported. The objects holding
+plaintext data, e.g. persisted before enabling encryption, are listed as well,
+except for the locks and the objects of the 'plaintext' policies. The keys rotated
+are appended to the --progress file, if given, and skipped when the rotation
+is run again, so an interrupted rotation can be resumed. Objects failing to
+rotate are listed at the end, and the command exits with a non-zero code.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdRotate),
+			}
+			rotate.Flags().StringP("config", "c", "", "Configuration file")
+			rotate.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			rotate.Flags().Bool("dry-run", false, "Report the data to be rotated without rewriting it")
+			rotate.Flags().Int("concurrency", 4, "Number of objects rotated concurrently")
+			rotate.Flags().String("progress", "", "File recording the rotated objects to resume from")
+			cmd.AddCommand(rotate)
+
+			migrate := &cobra.Command{
+				Use:   "migrate --from <config|json> --to <config|json> [--from-adapter <name>] [--to-adapter <name>] [--exclude <prefix>...]",
+				Short: "Copies the data from a storage to another",
+				Long: `
+Copies every object of the --from storage into the --to storage under the same
+key, so the layout expected by Caddy is preserved. Each storage is given as the
+path of a config, whose storage is used, or as the JSON of a storage module, e.g.
+'{"module": "file_system", "root": "/var/lib/caddy/.local/share/caddy"}'.
+
+Copying into an 'encrypted' storage encrypts the data, e.g. from the plaintext
+'file_system' storage to an 'encrypted' storage over another backend, and copying
+out of it decrypts the data. Each object is loaded back from the --to storage
+and compared to the original. Objects failing to copy are listed at the end, and
+the command exits with a non-zero code.
+
+The keys of the given --exclude prefixes are skipped. By default, the lock files
+of the 'file_system' storage under 'locks/' are skipped.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdMigrate),
+			}
+			migrate.Flags().String("from", "", "Configuration file or storage module JSON to copy from")
+			migrate.Flags().String("from-adapter", "", "Name of config adapter to apply to the --from config")
+			migrate.Flags().String("to", "", "Configuration file or storage module JSON to copy to")
+			migrate.Flags().String("to-adapter", "", "Name of config adapter to apply to the --to config")
+			migrate.Flags().StringSlice("exclude", []string{"locks/"}, "Key prefixes to skip")
+			cmd.AddCommand(migrate)
+
+			decrypt := &cobra.Command{
+				Use:   "decrypt [--config <path> [--adapter <name>]] <key>",
+				Short: "Prints the decrypted data of a stored object",
+				Long: `
+Loads the object of the given storage key through the 'encrypted' storage of the
+given config, and prints the decrypted data to stdout.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdDecrypt),
+			}
+			encrypt := &cobra.Command{
+				Use:   "encrypt [--config <path> [--adapter <name>]] <key> <file>",
+				Short: "Stores a local file encrypted",
+				Long: `
+Stores the contents of the given file, or of stdin if the file is '-', under the
+given storage key through the 'encrypted' storage of the given config.
+`,
+				Args: cobra.ExactArgs(2),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdEncrypt),
+			}
+			inspect := &cobra.Command{
+				Use:   "inspect [--config <path> [--adapter <name>]] <key>",
+				Short: "Prints the metadata of a stored object",
+				Long: `
+Prints the metadata of the object of the given storage key without printing its
+data: the format, the last modification time, the keys of each key group, whether
+the MAC is valid, and whether the data is bound to the key. Verifying the MAC
+requires the configured keys to decrypt the data key; otherwise, the MAC is
+reported as unverified.
+`,
+				Args: cobra.ExactArgs(1),
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdInspect),
+			}
+			for _, c := range []*cobra.Command{decrypt, encrypt, inspect} {
+				c.Flags().StringP("config", "c", "", "Configuration file")
+				c.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+				cmd.AddCommand(c)
+			}
+		},
+	})
+}
+
+func cmdSopsKeyService(fl caddycmd.Flags) (int, error) {
+	caddy.TrapSignals()
+
+	cfgJSON, _, err := caddycmd.LoadConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	var cfg caddy.Config
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("decoding config: %v", err)
+	}
+	app, ok := cfg.AppsRaw["sops_keyservice"]
+	if !ok {
+		return caddy.ExitCodeFailedStartup, errors.New("config does not contain the 'sops_keyservice' app")
+	}
+	persist := false
+	err = caddy.Run(&caddy.Config{
+		// the config holds key credentials, so it must not be autosaved
+		Admin: &caddy.AdminConfig{
+			Disabled: true,
+			Config:   &caddy.ConfigSettings{Persist: &persist},
+		},
+		Logging: cfg.Logging,
+		AppsRaw: caddy.ModuleMap{"sops_keyservice": app},
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("starting key service: %v", err)
+	}
+	caddy.Log().Info("serving key service")
+
+	select {}
+}
+
+// loadStorage provisions the 'encrypted' storage of the given config.
+func loadStorage(configFile, adapter string) (*Storage, context.CancelFunc, error) {
+	storage, cancel, err := loadStorageModule(configFile, adapter)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, ok := storage.(*Storage)
+	if !ok {
+		cancel()
+		return nil, nil, fmt.Errorf("storage of the config is '%T', not the 'encrypted' storage", storage)
+	}
+	return s, cancel, nil
+}
+
+// loadStorageModule provisions the storage of the given config, or the storage module
+// given inline as JSON, e.g. `{"module": "file_system", "root": "/var/lib/caddy"}`.
+func loadStorageModule(source, adapter string) (certmagic.Storage, context.CancelFunc, error) {
+	var cfg caddy.Config
+	if strings.HasPrefix(strings.TrimSpace(source), "{") {
+		cfg.StorageRaw = json.RawMessage(source)
+	} else {
+		cfgJSON, _, err := caddycmd.LoadConfig(source, adapter)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("decoding config: %v", err)
+		}
+	}
+	if cfg.StorageRaw == nil {
+		return nil, nil, errors.New("config does not configure a storage")
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	istorage, err := ctx.LoadModule(&cfg, "StorageRaw")
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("loading storage: %v", err)
+	}
+	storage, err := istorage.(caddy.StorageConverter).CertMagicStorage()
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("creating storage: %v", err)
+	}
+	return storage, cancel, nil
+}
+
+func cmdRotate(fl caddycmd.Flags) (int, error) {
+	s, cancel, err := loadStorage(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	r := &rotation{
+		storage:      s,
+		dryRun:       fl.Bool("dry-run"),
+		concurrency:  fl.Int("concurrency"),
+		progressFile: fl.String("progress"),
+	}
+	summary, err := r.run(ctx)
+	if summary == nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	verb := "rotated"
+	if r.dryRun {
+		verb = "to rotate"
+	}
+	for _, key := range summary.rotated {
+		fmt.Printf("%s: %s\n", verb, key)
+	}
+	for _, key := range summary.plaintext {
+		fmt.Printf("plaintext: %s\n", key)
+	}
+	failed := make([]string, 0, len(summary.failed))
+	for key := range summary.failed {
+		failed = append(failed, key)
+	}
+	sort.Strings(failed)
+	for _, key := range failed {
+		fmt.Printf("failed: %s: %v\n", key, summary.failed[key])
+	}
+	fmt.Printf("%d %s, %d skipped, %d plaintext, %d previously rotated, %d failed\n",
+		len(summary.rotated), verb, len(summary.skipped), len(summary.plaintext), len(summary.resumed), len(failed))
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	if len(failed) > 0 {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("failed to rotate %d objects", len(failed))
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdMigrate(fl caddycmd.Flags) (int, error) {
+	if fl.String("from") == "" || fl.String("to") == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("both --from and --to are required")
+	}
+	from, cancelFrom, err := loadStorageModule(fl.String("from"), fl.String("from-adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("loading --from storage: %v", err)
+	}
+	defer cancelFrom()
+	to, cancelTo, err := loadStorageModule(fl.String("to"), fl.String("to-adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("loading --to storage: %v", err)
+	}
+	defer cancelTo()
+	exclude, err := fl.GetStringSlice("exclude")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	m := &migration{from: from, to: to, exclude: exclude, out: os.Stdout}
+	summary, err := m.run(ctx)
+	if summary == nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	failed := make([]string, 0, len(summary.failed))
+	for key := range summary.failed {
+		failed = append(failed, key)
+	}
+	sort.Strings(failed)
+	for _, key := range failed {
+		fmt.Printf("failed: %s: %v\n", key, summary.failed[key])
+	}
+	fmt.Printf("%d copied, %d excluded, %d failed\n", len(summary.copied), len(summary.excluded), len(failed))
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	if len(failed) > 0 {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("failed to copy %d objects", len(failed))
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdDecrypt(fl caddycmd.Flags) (int, error) {
+	s, cancel, err := loadStorage(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+	data, err := s.Load(context.Background(), fl.Arg(0))
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	if _, err := os.Stdout.Write(data); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdEncrypt(fl caddycmd.Flags) (int, error) {
+	s, cancel, err := loadStorage(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+	var data []byte
+	if file := fl.Arg(1); file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("reading data: %v", err)
+	}
+	if err := s.Store(context.Background(), fl.Arg(0), data); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+func cmdInspect(fl caddycmd.Flags) (int, error) {
+	s, cancel, err := loadStorage(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cancel()
+	if err := s.inspect(context.Background(), fl.Arg(0), os.Stdout); err != nil {
+		return caddy.ExitCodeFailedQuit, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
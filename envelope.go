@@ -0,0 +1,247 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/stores"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The formats of the stored data.
+const (
+	formatSOPS     = "sops"
+	formatEnvelope = "envelope"
+)
+
+// The content ciphers of the envelope format.
+const (
+	cipherAESGCM            = "aes-256-gcm"
+	cipherXChaCha20Poly1305 = "xchacha20-poly1305"
+)
+
+// The envelope format is the compact binary alternative to the SOPS JSON document:
+//
+//	magic (4 bytes) | version (1 byte) | cipher (1 byte) | header length (4 bytes, big-endian) |
+//	header | nonce | ciphertext
+//
+// The header is the SOPS metadata in JSON, i.e. the data key wrapped with each of the keys of
+// the key groups the same way SOPS does, and the modification time. The data is encrypted
+// with the data key using everything before the nonce, followed by the length-prefixed storage
+// key, as the additional data, so the header is authenticated along with the data, and the data
+// is bound to its storage key.
+const (
+	// envelopeMagic prefixes the data in the envelope format. Neither JSON nor text starts with it.
+	envelopeMagic   = "\x89CSE"
+	envelopeVersion = 1
+
+	envelopePrefixSize = len(envelopeMagic) + 1 + 1 + 4
+	envelopeOverhead   = 16
+)
+
+// envelopeCipher is a content cipher of the envelope format.
+type envelopeCipher struct {
+	id        byte
+	nonceSize int
+	new       func(key []byte) (cipher.AEAD, error)
+}
+
+var envelopeCiphers = map[string]envelopeCipher{
+	cipherAESGCM: {
+		id:        1,
+		nonceSize: 12,
+		new: func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		},
+	},
+	cipherXChaCha20Poly1305: {
+		id:        2,
+		nonceSize: chacha20poly1305.NonceSizeX,
+		new:       chacha20poly1305.NewX,
+	},
+}
+
+// envelope is the parsed data in the envelope format.
+type envelope struct {
+	cipher     string
+	metadata   sops.Metadata
+	header     []byte
+	nonce      []byte
+	ciphertext []byte
+}
+
+// isEnvelope reports whether the data is in the envelope format.
+func isEnvelope(bs []byte) bool {
+	return bytes.HasPrefix(bs, []byte(envelopeMagic))
+}
+
+// parseEnvelope parses the data in the envelope format without decrypting it.
+func parseEnvelope(bs []byte) (*envelope, error) {
+	if !isEnvelope(bs) || len(bs) < envelopePrefixSize {
+		return nil, fmt.Errorf("%w: truncated envelope", ErrMalformed)
+	}
+	if v := bs[len(envelopeMagic)]; v != envelopeVersion {
+		return nil, fmt.Errorf("%w: unsupported envelope version %d", ErrMalformed, v)
+	}
+	e := new(envelope)
+	var c envelopeCipher
+	for name, ec := range envelopeCiphers {
+		if ec.id == bs[len(envelopeMagic)+1] {
+			e.cipher, c = name, ec
+		}
+	}
+	if e.cipher == "" {
+		return nil, fmt.Errorf("%w: unknown envelope cipher %d", ErrMalformed, bs[len(envelopeMagic)+1])
+	}
+	// compared in 64 bits, as the header length may not fit an int on 32-bit platforms
+	headerSize := uint64(binary.BigEndian.Uint32(bs[envelopePrefixSize-4:]))
+	if uint64(len(bs)) < uint64(envelopePrefixSize+c.nonceSize+envelopeOverhead)+headerSize {
+		return nil, fmt.Errorf("%w: truncated envelope", ErrMalformed)
+	}
+	header := bs[envelopePrefixSize : envelopePrefixSize+int(headerSize)]
+	var md stores.Metadata
+	if err := json.Unmarshal(header, &md); err != nil {
+		return nil, fmt.Errorf("%w: bad envelope header: %v", ErrMalformed, err)
+	}
+	metadata, err := md.ToInternal()
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad envelope header: %v", ErrMalformed, err)
+	}
+	e.metadata = metadata
+	rest := envelopePrefixSize + int(headerSize)
+	e.header = bs[:rest]
+	e.nonce = bs[rest : rest+c.nonceSize]
+	e.ciphertext = bs[rest+c.nonceSize:]
+	return e, nil
+}
+
+// plaintextSize returns the size of the data encrypted in the envelope.
+func (e *envelope) plaintextSize() int64 {
+	return int64(len(e.ciphertext) - envelopeOverhead)
+}
+
+// envelopeAdditionalData returns the additional data of the envelope, i.e. everything before
+// the nonce followed by the length-prefixed storage key, binding the data to the storage key.
+func envelopeAdditionalData(header []byte, key string) []byte {
+	additional := make([]byte, 0, len(header)+4+len(key))
+	additional = append(additional, header...)
+	additional = binary.BigEndian.AppendUint32(additional, uint32(len(key)))
+	return append(additional, key...)
+}
+
+// sealEnvelope encrypts the data of the key in the envelope format with a newly generated
+// data key, which is wrapped with the current key groups of the key.
+func (s *Storage) sealEnvelope(key string, plaintext []byte) ([]byte, error) {
+	groups, threshold := s.keyGroupsOf(key)
+	tree := sops.Tree{
+		Metadata: sops.Metadata{
+			LastModified:    time.Now().UTC(),
+			KeyGroups:       copyKeyGroups(groups),
+			ShamirThreshold: threshold,
+		},
+		FilePath: key,
+	}
+	keyServices, unavailable := s.observeKeyServices()
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices(keyServices)
+	if len(errs) > 0 {
+		if unavailable.Load() {
+			return nil, fmt.Errorf("%w: could not generate data key: %s", ErrKeyServiceUnavailable, errs)
+		}
+		return nil, fmt.Errorf("%w: could not generate data key: %s", ErrEncryption, errs)
+	}
+	header, err := json.Marshal(stores.MetadataFromInternal(tree.Metadata))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEncryption, err)
+	}
+
+	c := envelopeCiphers[s.Cipher]
+	aead, err := c.new(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEncryption, err)
+	}
+	bs := make([]byte, 0, envelopePrefixSize+len(header)+c.nonceSize+len(plaintext)+aead.Overhead())
+	bs = append(bs, envelopeMagic...)
+	bs = append(bs, envelopeVersion, c.id)
+	bs = binary.BigEndian.AppendUint32(bs, uint32(len(header)))
+	bs = append(bs, header...)
+	additional := envelopeAdditionalData(bs, key)
+	nonce := make([]byte, c.nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEncryption, err)
+	}
+	bs = append(bs, nonce...)
+	return aead.Seal(bs, nonce, plaintext, additional), nil
+}
+
+// openEnvelope decrypts the data of the key in the envelope format, and verifies the data
+// and its header are authentic and that the data is bound to the key.
+func (s *Storage) openEnvelope(key string, bs []byte) ([]byte, sops.Metadata, error) {
+	e, err := parseEnvelope(bs)
+	if err != nil {
+		return nil, sops.Metadata{}, err
+	}
+	keyServices, unavailable := s.observeKeyServices()
+	dataKey, err := e.metadata.GetDataKeyWithKeyServices(keyServices, nil)
+	if err != nil {
+		if unavailable.Load() {
+			return nil, e.metadata, fmt.Errorf("%w: could not decrypt data key: %v", ErrKeyServiceUnavailable, err)
+		}
+		return nil, e.metadata, fmt.Errorf("%w: could not decrypt data key: %v", ErrDecryption, err)
+	}
+	aead, err := envelopeCiphers[e.cipher].new(dataKey)
+	if err != nil {
+		return nil, e.metadata, fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	plaintext, err := aead.Open(nil, e.nonce, e.ciphertext, envelopeAdditionalData(e.header, key))
+	if err != nil {
+		// the storage key is authenticated along with the data, so either may not match
+		return nil, e.metadata, fmt.Errorf("%w or %w: the data or its header was tampered with, or the data is bound to another key: %v",
+			ErrMACMismatch, ErrKeyMismatch, err)
+	}
+	return plaintext, e.metadata, nil
+}
+
+// encrypt encrypts the data of the key in the configured format.
+func (s *Storage) encrypt(key string, plaintext []byte) ([]byte, error) {
+	if s.Format == formatEnvelope {
+		return s.sealEnvelope(key, plaintext)
+	}
+	branches, err := s.store.LoadPlainFile(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return s.encryptBranches(key, branches)
+}
+
+// decrypt decrypts the data of the key in either format. The error of loading
+// data which is not encrypted wraps `sops.MetadataNotFound`.
+func (s *Storage) decrypt(key string, bs []byte) ([]byte, error) {
+	if isEnvelope(bs) {
+		plaintext, _, err := s.openEnvelope(key, bs)
+		return plaintext, err
+	}
+	tree, err := s.store.LoadEncryptedFile(bs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error loading encrypted file: %w", ErrMalformed, err)
+	}
+	tree.FilePath = key
+	if err := s.decryptTree(&tree); err != nil {
+		return nil, err
+	}
+	plaintext, err := s.store.EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,201 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestStorageEnvelope(t *testing.T) {
+	for _, c := range []string{cipherAESGCM, cipherXChaCha20Poly1305} {
+		t.Run(c, func(t *testing.T) {
+			dir := t.TempDir()
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"format": "envelope", "cipher": %q, "encryption": [{"provider": "local", "keys": [%s]}]}`, c, ageKey(recipient, ageId)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sopsStorage, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Store(ctx, key, []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			if err := sopsStorage.Store(ctx, "sops", []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := s.backend.Load(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sopsRaw, err := s.backend.Load(ctx, "sops")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isEnvelope(raw) || bytes.Contains(raw, []byte(val)) {
+				t.Fatalf("expected the data to be encrypted in the envelope format: %q", raw)
+			}
+			if len(raw) >= len(sopsRaw) {
+				t.Errorf("expected the envelope to be smaller than the SOPS document: %d >= %d", len(raw), len(sopsRaw))
+			}
+
+			// both formats are loaded by either storage
+			for _, storage := range []*Storage{s, sopsStorage} {
+				for _, k := range []string{key, "sops"} {
+					data, err := storage.Load(ctx, k)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(data) != val {
+						t.Errorf("%s: data mismatch: %s != %s", k, data, val)
+					}
+				}
+			}
+			stat, err := s.Stat(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Size != int64(len(val)) {
+				t.Errorf("size mismatch: %d != %d", stat.Size, len(val))
+			}
+
+			store := func(k string, data []byte) string {
+				if err := s.backend.Store(ctx, k, data); err != nil {
+					t.Fatal(err)
+				}
+				return k
+			}
+			tampered := bytes.Clone(raw)
+			i := bytes.Index(tampered, []byte(`"lastmodified":"`)) + len(`"lastmodified":"`)
+			tampered[i] = '1'
+			oversized := bytes.Clone(raw)
+			copy(oversized[envelopePrefixSize-4:], "\xff\xff\xff\xff")
+			other, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"format": "envelope", "encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient2, ageId2)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			testcases := []struct {
+				name    string
+				storage *Storage
+				key     string
+				want    error
+			}{
+				{name: "swapped key", storage: s, key: store("swapped", raw), want: ErrKeyMismatch},
+				{name: "tampered header", storage: s, key: store("tampered-header", tampered), want: ErrMACMismatch},
+				{name: "tampered data", storage: s, key: store("tampered-data", append(bytes.Clone(raw[:len(raw)-1]), raw[len(raw)-1]^1)), want: ErrMACMismatch},
+				{name: "oversized header", storage: s, key: store("oversized", oversized), want: ErrMalformed},
+				{name: "truncated", storage: s, key: store("truncated", raw[:len(raw)/2]), want: ErrMalformed},
+				{name: "unsupported version", storage: s, key: store("version", append([]byte(envelopeMagic+"\x02"), raw[len(envelopeMagic)+1:]...)), want: ErrMalformed},
+				{name: "unknown key", storage: other, key: key, want: ErrDecryption},
+			}
+			for _, tc := range testcases {
+				if _, err := tc.storage.Load(ctx, tc.key); !errors.Is(err, tc.want) {
+					t.Errorf("%s: expected error to be %v, got: %v", tc.name, tc.want, err)
+				}
+			}
+
+			var out strings.Builder
+			if err := s.inspect(ctx, key, &out); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{
+				"format: envelope, " + c,
+				fmt.Sprintf("plaintext size: %d bytes", len(val)),
+				"  group 0:\n    age: " + recipient,
+				"mac: valid",
+				"bound key: matches",
+			} {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("expected output to contain %q, got:\n%s", want, out.String())
+				}
+			}
+			out.Reset()
+			if err := s.inspect(ctx, "swapped", &out); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), "bound key: mismatch") {
+				t.Errorf("expected the bound key to mismatch, got:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestStorageEnvelopeKeyGroups(t *testing.T) {
+	err := storeAndLoad(t, t.TempDir(),
+		fmt.Sprintf(`{"format": "envelope", "shamir_threshold": 2, "encryption": [{"provider": "local", "keys": [%s, %s, %s]}]}`, ageKey(recipient), ageKey(recipient2), ageKey(recipient3)),
+		fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s, %s]}]}`, ageKey(recipient, ageId), ageKey(recipient3, ageId3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storeAndLoad(t, t.TempDir(),
+		fmt.Sprintf(`{"format": "envelope", "shamir_threshold": 2, "encryption": [{"provider": "local", "keys": [%s, %s, %s]}]}`, ageKey(recipient), ageKey(recipient2), ageKey(recipient3)),
+		fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err == nil {
+		t.Fatal("expected a single key group to not decrypt the data")
+	}
+}
+
+func TestStorageEnvelopeConversion(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	sopsStorage, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"format": "envelope", "reencrypt_on_load": true, "encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"loaded", "rotated"} {
+		if err := sopsStorage.Store(ctx, k, []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the data is converted to the configured format once loaded, or rotated
+	if _, err := s.Load(ctx, "loaded"); err != nil {
+		t.Fatal(err)
+	}
+	s.rewrites.wait()
+	summary, err := (&rotation{storage: s, concurrency: 1}).run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.failed) != 0 {
+		t.Fatalf("failed: %v", summary.failed)
+	}
+	for _, k := range []string{"loaded", "rotated"} {
+		raw, err := s.backend.Load(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isEnvelope(raw) {
+			t.Errorf("%s: expected the data to be converted to the envelope format", k)
+		}
+		data, err := sopsStorage.Load(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != val {
+			t.Errorf("%s: data mismatch: %s != %s", k, data, val)
+		}
+	}
+
+	for _, config := range []string{
+		`{"format": "binary", "encryption": [{"provider": "local", "keys": [%s]}]}`,
+		`{"format": "envelope", "cipher": "aes-128-cbc", "encryption": [{"provider": "local", "keys": [%s]}]}`,
+		`{"cipher": "xchacha20-poly1305", "encryption": [{"provider": "local", "keys": [%s]}]}`,
+	} {
+		if _, err := provisionStorage(ctx, dir, fmt.Sprintf(config, ageKey(recipient, ageId))); err == nil {
+			t.Errorf("expected provisioning to fail: %s", config)
+		}
+	}
+}
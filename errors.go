@@ -0,0 +1,105 @@
+package encryptedstorage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync/atomic"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The errors of the `encrypted` storage operations. The errors returned by the storage
+// wrap one of them, to be checked with `errors.Is`, alongside the underlying error.
+var (
+	// ErrNotExist reports the key does not exist in the backend. It is `fs.ErrNotExist`,
+	// which certmagic relies on, e.g. to decide whether to obtain a new certificate.
+	ErrNotExist = fs.ErrNotExist
+
+	// ErrMalformed reports the data is not a valid encrypted file, e.g. plaintext
+	// data or truncated encrypted data, or the plaintext data cannot be stored.
+	ErrMalformed = errors.New("malformed data")
+
+	// ErrDecryption reports the data key or the data cannot be decrypted, e.g. none
+	// of the configured keys can decrypt the data key.
+	ErrDecryption = errors.New("decryption failed")
+
+	// ErrEncryption reports the data key or the data cannot be encrypted.
+	ErrEncryption = errors.New("encryption failed")
+
+	// ErrMACMismatch reports the data does not match its MAC, e.g. the encrypted
+	// data or its unencrypted metadata has been tampered with.
+	ErrMACMismatch = errors.New("MAC mismatch")
+
+	// ErrKeyMismatch reports the data is not bound to the storage key it is loaded
+	// from, e.g. copied over from another key.
+	ErrKeyMismatch = errors.New("storage key mismatch")
+
+	// ErrDenied reports the key is denied by a policy of the storage.
+	ErrDenied = errors.New("denied by policy")
+
+	// ErrKeyServiceUnavailable reports the data key cannot be encrypted or decrypted
+	// while a key service is unreachable, so the operation may succeed when retried.
+	ErrKeyServiceUnavailable = errors.New("key service unavailable")
+)
+
+// observedKeyService records whether the key service is unreachable, as SOPS
+// does not preserve the errors of the key services.
+type observedKeyService struct {
+	keyservice.KeyServiceClient
+	unavailable *atomic.Bool
+}
+
+// observeKeyServices wraps the key service clients of the storage for a single operation, and
+// returns them along with the flag reporting whether any of the key services was unreachable.
+func (s *Storage) observeKeyServices() ([]keyservice.KeyServiceClient, *atomic.Bool) {
+	unavailable := new(atomic.Bool)
+	clients := make([]keyservice.KeyServiceClient, 0, len(s.keyServiceClients))
+	for _, c := range s.keyServiceClients {
+		clients = append(clients, observedKeyService{KeyServiceClient: c, unavailable: unavailable})
+	}
+	return clients, unavailable
+}
+
+// Encrypt implements keyservice.KeyServiceClient.
+func (o observedKeyService) Encrypt(ctx context.Context, in *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	resp, err := o.KeyServiceClient.Encrypt(ctx, in, opts...)
+	if isUnavailable(err) {
+		o.unavailable.Store(true)
+	}
+	return resp, err
+}
+
+// Decrypt implements keyservice.KeyServiceClient.
+func (o observedKeyService) Decrypt(ctx context.Context, in *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	resp, err := o.KeyServiceClient.Decrypt(ctx, in, opts...)
+	if isUnavailable(err) {
+		o.unavailable.Store(true)
+	}
+	return resp, err
+}
+
+// isUnavailable reports whether the error, or any of the joined errors, is of an unreachable key service.
+func isUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			if isUnavailable(err) {
+				return true
+			}
+		}
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+var _ keyservice.KeyServiceClient = observedKeyService{}
@@ -0,0 +1,178 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// closedAddress returns the address of a TCP port nothing listens on.
+func closedAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestStorageLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, key, []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := s.backend.Load(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(k string, data []byte) string {
+		if err := s.backend.Store(ctx, k, data); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	other, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient2, ageId2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "remote", "address": %q, "insecure": true, "keys": [%s]}]}`, closedAddress(t), ageKey(recipient)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name    string
+		storage *Storage
+		key     string
+		want    error
+	}{
+		{
+			name:    "not exist",
+			storage: s,
+			key:     "missing",
+			want:    fs.ErrNotExist,
+		},
+		{
+			name:    "plaintext",
+			storage: s,
+			key:     store("plaintext", []byte(val)),
+			want:    ErrMalformed,
+		},
+		{
+			name:    "truncated",
+			storage: s,
+			key:     store("truncated", raw[:len(raw)/2]),
+			want:    ErrMalformed,
+		},
+		{
+			name:    "unknown key",
+			storage: other,
+			key:     key,
+			want:    ErrDecryption,
+		},
+		{
+			name:    "tampered data",
+			storage: s,
+			key:     store("tampered-size", bytes.Replace(raw, []byte(fmt.Sprintf(`"%s": %d`, sizeKey, len(val))), []byte(fmt.Sprintf(`"%s": 1`, sizeKey)), 1)),
+			want:    ErrMACMismatch,
+		},
+		{
+			name:    "tampered modification time",
+			storage: s,
+			key:     store("tampered-time", regexp.MustCompile(`"lastmodified": "[^"]+"`).ReplaceAll(raw, []byte(`"lastmodified": "2000-01-01T00:00:00Z"`))),
+			want:    ErrMACMismatch,
+		},
+		{
+			name:    "swapped key",
+			storage: s,
+			key:     store("swapped", raw),
+			want:    ErrKeyMismatch,
+		},
+		{
+			name:    "unreachable key service",
+			storage: unreachable,
+			key:     key,
+			want:    ErrKeyServiceUnavailable,
+		},
+	}
+	kinds := []error{ErrNotExist, ErrMalformed, ErrDecryption, ErrEncryption, ErrMACMismatch, ErrKeyMismatch, ErrDenied, ErrKeyServiceUnavailable}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.storage.Load(ctx, tc.key)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("expected error to be %v, got: %v", tc.want, err)
+			}
+			for _, kind := range kinds {
+				if kind != tc.want && errors.Is(err, kind) {
+					t.Errorf("error is also %v: %v", kind, err)
+				}
+			}
+		})
+	}
+}
+
+func TestStorageStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type": "DisabledException", "message": "key is disabled"}`)
+	}))
+	t.Cleanup(kms.Close)
+	disabled, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [{"type": "aws_kms", "arn": %q, "endpoint": %q, "access_key_id": "AKID", "secret_access_key": "secret"}]}]}`,
+		"arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab", kms.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "remote", "address": %q, "insecure": true, "keys": [%s]}]}`, closedAddress(t), ageKey(recipient)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name    string
+		storage *Storage
+		want    error
+	}{
+		{
+			name:    "key fails to encrypt",
+			storage: disabled,
+			want:    ErrEncryption,
+		},
+		{
+			name:    "unreachable key service",
+			storage: unreachable,
+			want:    ErrKeyServiceUnavailable,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.storage.Store(ctx, key, []byte(val))
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("expected error to be %v, got: %v", tc.want, err)
+			}
+			if tc.storage.Exists(ctx, key) {
+				t.Error("the data is stored")
+			}
+		})
+	}
+}
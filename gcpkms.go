@@ -53,7 +53,7 @@ func (GCPKMS) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// ToMasterkey implements Masterkeyer.
+// ToMasterkey implements MasterkeyConverter.
 func (gcp *GCPKMS) ToMasterkey() keys.MasterKey {
 	return gcp.mk
 }
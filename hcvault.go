@@ -0,0 +1,332 @@
+package encryptedstorage
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/getsops/sops/v3/hcvault"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/hashicorp/vault/api"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(HashiCorpVault{})
+}
+
+// HashiCorpVault uses a key of the Transit secrets engine of HashiCorp Vault for the encryption/decryption.
+// See more: [https://github.com/getsops/sops#encrypting-using-hashicorp-vault](https://github.com/getsops/sops#encrypting-using-hashicorp-vault)
+type HashiCorpVault struct {
+	// The address of the Vault server, e.g. `https://vault.internal:8200`.
+	Address string `json:"address,omitempty"`
+
+	// The mount path of the Transit secrets engine. Defaults to `transit`.
+	EnginePath string `json:"engine_path,omitempty"`
+
+	// The name of the Transit key.
+	KeyName string `json:"key_name,omitempty"`
+
+	// The Vault token. If no authentication method is configured, the token is
+	// obtained the same way as the `vault` CLI, i.e. `VAULT_TOKEN` or `~/.vault-token`.
+	Token string `json:"token,omitempty"`
+
+	// Authenticate with the AppRole auth method.
+	AppRole *VaultAppRoleAuth `json:"approle,omitempty"`
+
+	// Authenticate with the Kubernetes auth method.
+	Kubernetes *VaultKubernetesAuth `json:"kubernetes,omitempty"`
+
+	// The Vault Enterprise namespace.
+	Namespace string `json:"namespace,omitempty"`
+
+	// The path of the PEM-encoded CA certificate file to verify the Vault server certificate.
+	CACert string `json:"ca_cert,omitempty"`
+
+	// The path of a directory of PEM-encoded CA certificate files to verify the Vault server certificate.
+	CAPath string `json:"ca_path,omitempty"`
+
+	// The server name used to verify the Vault server certificate.
+	TLSServerName string `json:"tls_server_name,omitempty"`
+
+	client *api.Client
+	// login obtains a token from the configured auth method, if any
+	login   func() (string, error)
+	loginMu *sync.Mutex
+	mk      *hcvault.MasterKey
+}
+
+// VaultAppRoleAuth configures the AppRole auth method of Vault.
+type VaultAppRoleAuth struct {
+	// The mount path of the auth method. Defaults to `approle`.
+	MountPath string `json:"mount_path,omitempty"`
+
+	// The role ID.
+	RoleID string `json:"role_id,omitempty"`
+
+	// The secret ID.
+	SecretID string `json:"secret_id,omitempty"`
+}
+
+// VaultKubernetesAuth configures the Kubernetes auth method of Vault.
+type VaultKubernetesAuth struct {
+	// The mount path of the auth method. Defaults to `kubernetes`.
+	MountPath string `json:"mount_path,omitempty"`
+
+	// The Vault role bound to the service account.
+	Role string `json:"role,omitempty"`
+
+	// The path of the service account token. Defaults to
+	// `/var/run/secrets/kubernetes.io/serviceaccount/token`.
+	TokenFile string `json:"token_file,omitempty"`
+}
+
+// Provision implements caddy.Provisioner.
+func (v *HashiCorpVault) Provision(ctx caddy.Context) error {
+	r, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		r = caddy.NewReplacer()
+	}
+	v.Address = r.ReplaceKnown(v.Address, "")
+	v.EnginePath = strings.Trim(r.ReplaceKnown(v.EnginePath, ""), "/")
+	v.KeyName = r.ReplaceKnown(v.KeyName, "")
+	if len(v.Address) == 0 {
+		return errors.New("missing address")
+	}
+	if len(v.KeyName) == 0 {
+		return errors.New("missing key_name")
+	}
+	if len(v.EnginePath) == 0 {
+		v.EnginePath = "transit"
+	}
+
+	cfg := api.DefaultConfig()
+	if cfg.Error != nil {
+		return fmt.Errorf("reading Vault environment: %v", cfg.Error)
+	}
+	cfg.Address = v.Address
+	if len(v.CACert) > 0 || len(v.CAPath) > 0 || len(v.TLSServerName) > 0 {
+		err := cfg.ConfigureTLS(&api.TLSConfig{
+			CACert:        r.ReplaceKnown(v.CACert, ""),
+			CAPath:        r.ReplaceKnown(v.CAPath, ""),
+			TLSServerName: r.ReplaceKnown(v.TLSServerName, ""),
+		})
+		if err != nil {
+			return fmt.Errorf("configuring Vault TLS: %v", err)
+		}
+	}
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return fmt.Errorf("creating Vault client: %v", err)
+	}
+	if ns := r.ReplaceKnown(v.Namespace, ""); len(ns) > 0 {
+		client.SetNamespace(ns)
+	}
+	v.client = client
+	v.loginMu = new(sync.Mutex)
+
+	methods := 0
+	if len(v.Token) > 0 {
+		methods++
+		client.SetToken(r.ReplaceKnown(v.Token, ""))
+	}
+	if v.AppRole != nil {
+		methods++
+		login, err := v.AppRole.loginFunc(client, r)
+		if err != nil {
+			return err
+		}
+		v.login = login
+	}
+	if v.Kubernetes != nil {
+		methods++
+		login, err := v.Kubernetes.loginFunc(client, r)
+		if err != nil {
+			return err
+		}
+		v.login = login
+	}
+	if methods > 1 {
+		return errors.New("fields 'token', 'approle', and 'kubernetes' are mutually exclusive")
+	}
+	if methods == 0 && len(client.Token()) == 0 {
+		// same as the `vault` CLI, which SOPS follows
+		if home, err := os.UserHomeDir(); err == nil {
+			if bs, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				client.SetToken(strings.TrimSpace(string(bs)))
+			}
+		}
+	}
+	v.mk = hcvault.NewMasterKey(v.Address, v.EnginePath, v.KeyName)
+	return nil
+}
+
+func (a *VaultAppRoleAuth) loginFunc(client *api.Client, r *caddy.Replacer) (func() (string, error), error) {
+	roleID, secretID := r.ReplaceKnown(a.RoleID, ""), r.ReplaceKnown(a.SecretID, "")
+	if len(roleID) == 0 {
+		return nil, errors.New("missing approle role_id")
+	}
+	mountPath := strings.Trim(r.ReplaceKnown(a.MountPath, ""), "/")
+	if len(mountPath) == 0 {
+		mountPath = "approle"
+	}
+	return func() (string, error) {
+		return vaultLogin(client, mountPath, map[string]any{
+			"role_id":   roleID,
+			"secret_id": secretID,
+		})
+	}, nil
+}
+
+func (k *VaultKubernetesAuth) loginFunc(client *api.Client, r *caddy.Replacer) (func() (string, error), error) {
+	role := r.ReplaceKnown(k.Role, "")
+	if len(role) == 0 {
+		return nil, errors.New("missing kubernetes role")
+	}
+	mountPath := strings.Trim(r.ReplaceKnown(k.MountPath, ""), "/")
+	if len(mountPath) == 0 {
+		mountPath = "kubernetes"
+	}
+	tokenFile := r.ReplaceKnown(k.TokenFile, "")
+	if len(tokenFile) == 0 {
+		tokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	return func() (string, error) {
+		// the service account token is rotated by the kubelet, so it's read on each login
+		jwt, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("reading service account token: %v", err)
+		}
+		return vaultLogin(client, mountPath, map[string]any{
+			"role": role,
+			"jwt":  strings.TrimSpace(string(jwt)),
+		})
+	}, nil
+}
+
+// vaultLogin logs into the auth method mounted at the path, returning the client token.
+func vaultLogin(client *api.Client, mountPath string, data map[string]any) (string, error) {
+	// the login request must not carry a (stale) token
+	c, err := client.Clone()
+	if err != nil {
+		return "", err
+	}
+	c.ClearToken()
+	secret, err := c.Logical().Write(path.Join("auth", mountPath, "login"), data)
+	if err != nil {
+		return "", fmt.Errorf("logging into Vault auth method '%s': %w", mountPath, err)
+	}
+	if secret == nil || secret.Auth == nil || len(secret.Auth.ClientToken) == 0 {
+		return "", fmt.Errorf("no token returned by Vault auth method '%s'", mountPath)
+	}
+	return secret.Auth.ClientToken, nil
+}
+
+// write writes the data to the path, logging in first if no token is obtained yet
+// and once more if the token is rejected, e.g. expired.
+func (v *HashiCorpVault) write(p string, data map[string]any) (*api.Secret, error) {
+	if v.login == nil {
+		return v.client.Logical().Write(p, data)
+	}
+	v.loginMu.Lock()
+	if len(v.client.Token()) == 0 {
+		token, err := v.login()
+		if err != nil {
+			v.loginMu.Unlock()
+			return nil, err
+		}
+		v.client.SetToken(token)
+	}
+	v.loginMu.Unlock()
+
+	secret, err := v.client.Logical().Write(p, data)
+	var respErr *api.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusForbidden {
+		return secret, err
+	}
+	v.loginMu.Lock()
+	token, err := v.login()
+	if err != nil {
+		v.loginMu.Unlock()
+		return nil, err
+	}
+	v.client.SetToken(token)
+	v.loginMu.Unlock()
+	return v.client.Logical().Write(p, data)
+}
+
+// matches implements keyCrypter.
+func (v *HashiCorpVault) matches(key *keyservice.Key) bool {
+	k, ok := key.GetKeyType().(*keyservice.Key_VaultKey)
+	return ok && k.VaultKey.VaultAddress == v.Address &&
+		k.VaultKey.EnginePath == v.EnginePath &&
+		k.VaultKey.KeyName == v.KeyName
+}
+
+// encrypt implements keyCrypter. The ciphertext is the one returned by Vault, as stored by SOPS.
+func (v *HashiCorpVault) encrypt(dataKey []byte) ([]byte, error) {
+	p := path.Join(v.EnginePath, "encrypt", v.KeyName)
+	secret, err := v.write(p, map[string]any{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data key with Vault transit backend '%s': %w", p, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("transit backend '%s' returned no data", p)
+	}
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("transit backend '%s' returned no ciphertext", p)
+	}
+	return []byte(ciphertext), nil
+}
+
+// decrypt implements keyCrypter.
+func (v *HashiCorpVault) decrypt(ciphertext []byte) ([]byte, error) {
+	p := path.Join(v.EnginePath, "decrypt", v.KeyName)
+	secret, err := v.write(p, map[string]any{
+		"ciphertext": string(ciphertext),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key with Vault transit backend '%s': %w", p, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("transit backend '%s' returned no data", p)
+	}
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("transit backend '%s' returned no plaintext", p)
+	}
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+// CaddyModule implements caddy.Module.
+func (HashiCorpVault) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.storage.encrypted.key.hc_vault",
+		New: func() caddy.Module {
+			return new(HashiCorpVault)
+		},
+	}
+}
+
+// ToMasterkey implements MasterkeyConverter.
+func (v *HashiCorpVault) ToMasterkey() keys.MasterKey {
+	return v.mk
+}
+
+var (
+	_ caddy.Module       = (*HashiCorpVault)(nil)
+	_ caddy.Provisioner  = (*HashiCorpVault)(nil)
+	_ MasterkeyConverter = (*HashiCorpVault)(nil)
+	_ keyCrypter         = (*HashiCorpVault)(nil)
+)
@@ -0,0 +1,231 @@
+package encryptedstorage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getsops/sops/v3/keyservice"
+)
+
+// fakeVault is a minimal emulator of the Vault Transit secrets engine mounted at `transit`,
+// and of the AppRole and Kubernetes auth methods.
+type fakeVault struct {
+	mu          sync.Mutex
+	namespace   string
+	tokens      map[string]bool
+	ciphertexts map[string]string
+	logins      int
+	requests    int
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	w.Header().Set("Content-Type", "application/json")
+	deny := func() {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+	}
+	if r.Header.Get("X-Vault-Namespace") != f.namespace {
+		deny()
+		return
+	}
+	var req map[string]string
+	json.NewDecoder(r.Body).Decode(&req)
+	switch {
+	case r.URL.Path == "/v1/auth/approle/login" && req["role_id"] == "caddy" && req["secret_id"] == "secret",
+		r.URL.Path == "/v1/auth/kubernetes/login" && req["role"] == "caddy" && req["jwt"] == "service-account-jwt":
+		f.logins++
+		token := fmt.Sprintf("login-token-%d", f.logins)
+		f.tokens[token] = true
+		json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": token}})
+	case r.URL.Path == "/v1/transit/encrypt/caddy" && f.tokens[r.Header.Get("X-Vault-Token")]:
+		id := make([]byte, 16)
+		rand.Read(id)
+		ciphertext := "vault:v1:" + base64.StdEncoding.EncodeToString(id)
+		f.ciphertexts[ciphertext] = req["plaintext"]
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{"ciphertext": ciphertext}})
+	case r.URL.Path == "/v1/transit/decrypt/caddy" && f.tokens[r.Header.Get("X-Vault-Token")]:
+		plaintext, ok := f.ciphertexts[req["ciphertext"]]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"invalid ciphertext"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]string{"plaintext": plaintext}})
+	default:
+		deny()
+	}
+}
+
+func newFakeVault(t *testing.T, namespace string) (*fakeVault, string) {
+	t.Helper()
+	fv := &fakeVault{
+		namespace:   namespace,
+		tokens:      map[string]bool{"root-token": true},
+		ciphertexts: make(map[string]string),
+	}
+	srv := httptest.NewServer(fv)
+	t.Cleanup(srv.Close)
+	return fv, srv.URL
+}
+
+func TestStorageWithHashiCorpVaultEncryption(t *testing.T) {
+	_, addr := newFakeVault(t, "")
+	_, nsAddr := newFakeVault(t, "team-a")
+	jwtFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwtFile, []byte("service-account-jwt\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_VAULT_TOKEN", "root-token")
+
+	local := func(fields string) string {
+		return fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [{"type": "hc_vault", "key_name": "caddy", %s}]}]}`, fields)
+	}
+	testcases := []struct {
+		name  string
+		store string
+		load  string
+		fails bool
+	}{
+		{
+			name:  "token",
+			store: local(fmt.Sprintf(`"address": %q, "token": "root-token"`, addr)),
+			load:  local(fmt.Sprintf(`"address": %q, "token": "root-token"`, addr)),
+		},
+		{
+			name:  "token from placeholder",
+			store: local(fmt.Sprintf(`"address": %q, "token": "{env.TEST_VAULT_TOKEN}"`, addr)),
+			load:  local(fmt.Sprintf(`"address": %q, "token": "{env.TEST_VAULT_TOKEN}"`, addr)),
+		},
+		{
+			name:  "approle",
+			store: local(fmt.Sprintf(`"address": %q, "approle": {"role_id": "caddy", "secret_id": "secret"}`, addr)),
+			load:  local(fmt.Sprintf(`"address": %q, "approle": {"role_id": "caddy", "secret_id": "secret"}`, addr)),
+		},
+		{
+			name:  "kubernetes",
+			store: local(fmt.Sprintf(`"address": %q, "kubernetes": {"role": "caddy", "token_file": %q}`, addr, jwtFile)),
+			load:  local(fmt.Sprintf(`"address": %q, "kubernetes": {"role": "caddy", "token_file": %q}`, addr, jwtFile)),
+		},
+		{
+			name:  "namespace",
+			store: local(fmt.Sprintf(`"address": %q, "namespace": "team-a", "token": "root-token"`, nsAddr)),
+			load:  local(fmt.Sprintf(`"address": %q, "namespace": "team-a", "token": "root-token"`, nsAddr)),
+		},
+		{
+			name:  "wrong namespace",
+			store: local(fmt.Sprintf(`"address": %q, "namespace": "team-b", "token": "root-token"`, nsAddr)),
+			fails: true,
+		},
+		{
+			name:  "wrong secret id",
+			store: local(fmt.Sprintf(`"address": %q, "approle": {"role_id": "caddy", "secret_id": "wrong"}`, addr)),
+			fails: true,
+		},
+		{
+			name:  "token and approle",
+			store: local(fmt.Sprintf(`"address": %q, "token": "root-token", "approle": {"role_id": "caddy", "secret_id": "secret"}`, addr)),
+			fails: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := storeAndLoad(t, t.TempDir(), tc.store, tc.load)
+			if tc.fails && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tc.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHashiCorpVaultLoginAgainOnRevokedToken(t *testing.T) {
+	fv, addr := newFakeVault(t, "")
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	v := &HashiCorpVault{
+		Address: addr,
+		KeyName: "caddy",
+		AppRole: &VaultAppRoleAuth{RoleID: "caddy", SecretID: "secret"},
+	}
+	if err := v.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := v.encrypt([]byte(val))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fv.mu.Lock()
+	clear(fv.tokens)
+	fv.mu.Unlock()
+	plaintext, err := v.decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != val {
+		t.Errorf("data mismatch: %s != %s", plaintext, val)
+	}
+	if fv.logins != 2 {
+		t.Errorf("expected 2 logins, got %d", fv.logins)
+	}
+}
+
+func TestLocalUnknownVaultKey(t *testing.T) {
+	fv, addr := newFakeVault(t, "")
+	key := &keyservice.Key{KeyType: &keyservice.Key_VaultKey{VaultKey: &keyservice.VaultKey{
+		VaultAddress: addr,
+		EnginePath:   "transit",
+		KeyName:      "caddy",
+	}}}
+	l := new(Local)
+	if _, err := l.Encrypt(context.Background(), &keyservice.EncryptRequest{Key: key, Plaintext: []byte(val)}); err == nil || !strings.Contains(err.Error(), "no 'hc_vault' key") {
+		t.Errorf("expected an error encrypting with an unknown Vault key, got %v", err)
+	}
+	if _, err := l.Decrypt(context.Background(), &keyservice.DecryptRequest{Key: key, Ciphertext: []byte("vault:v1:Y2FkZHk=")}); err == nil || !strings.Contains(err.Error(), "no 'hc_vault' key") {
+		t.Errorf("expected an error decrypting with an unknown Vault key, got %v", err)
+	}
+	if fv.requests != 0 {
+		t.Errorf("expected no requests to Vault, got %d", fv.requests)
+	}
+}
+
+// TestStorageWithVaultDevServer runs against a Vault server started with `vault server -dev`,
+// given its address and root token in `VAULT_DEV_ADDR` and `VAULT_DEV_ROOT_TOKEN`.
+func TestStorageWithVaultDevServer(t *testing.T) {
+	addr, token := os.Getenv("VAULT_DEV_ADDR"), os.Getenv("VAULT_DEV_ROOT_TOKEN")
+	if addr == "" || token == "" {
+		t.Skip("VAULT_DEV_ADDR and VAULT_DEV_ROOT_TOKEN are not set")
+	}
+	// enable the transit engine and create the key; both fail harmlessly if done already
+	for _, req := range []struct{ path, body string }{
+		{"/v1/sys/mounts/transit", `{"type": "transit"}`},
+		{"/v1/transit/keys/caddy", `{}`},
+	} {
+		r, _ := http.NewRequest(http.MethodPost, strings.TrimSuffix(addr, "/")+req.path, strings.NewReader(req.body))
+		r.Header.Set("X-Vault-Token", token)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	cfg := fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [{"type": "hc_vault", "address": %q, "key_name": "caddy", "token": %q}]}]}`, addr, token)
+	if err := storeAndLoad(t, t.TempDir(), cfg, cfg); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,117 @@
+package encryptedstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/getsops/sops/v3"
+)
+
+// inspect writes the metadata of the stored object in either format, i.e. the key groups, the
+// validity of the MAC and the storage key the data is bound to, without revealing the data.
+func (s *Storage) inspect(ctx context.Context, key string, w io.Writer) error {
+	bs, err := s.backend.Load(ctx, key)
+	if err != nil {
+		return fmt.Errorf("backend load error: %w", err)
+	}
+	if isEnvelope(bs) {
+		return s.inspectEnvelope(key, bs, w)
+	}
+	tree, err := s.store.LoadEncryptedFile(bs)
+	if err != nil {
+		return fmt.Errorf("%w: error loading encrypted file: %v", ErrMalformed, err)
+	}
+	md := tree.Metadata
+
+	fmt.Fprintf(w, "key: %s\n", key)
+	fmt.Fprintf(w, "format: %s\n", formatSOPS)
+	fmt.Fprintf(w, "size: %d bytes\n", len(bs))
+	if size, ok := plaintextSize(tree.Branches); ok {
+		fmt.Fprintf(w, "plaintext size: %d bytes\n", size)
+	}
+	fmt.Fprintf(w, "sops version: %s\n", md.Version)
+	writeKeyGroups(w, md)
+	tree.FilePath = key
+	err = s.decryptTree(&tree)
+	fmt.Fprintf(w, "mac: %s\n", describeMAC(tree.Metadata, err))
+	fmt.Fprintf(w, "bound key: %s\n", describeBinding(key, tree, err))
+	return nil
+}
+
+// inspectEnvelope writes the metadata of the stored object in the envelope format.
+func (s *Storage) inspectEnvelope(key string, bs []byte, w io.Writer) error {
+	e, err := parseEnvelope(bs)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "key: %s\n", key)
+	fmt.Fprintf(w, "format: %s, %s\n", formatEnvelope, e.cipher)
+	fmt.Fprintf(w, "size: %d bytes\n", len(bs))
+	fmt.Fprintf(w, "plaintext size: %d bytes\n", e.plaintextSize())
+	writeKeyGroups(w, e.metadata)
+	_, md, err := s.openEnvelope(key, bs)
+	fmt.Fprintf(w, "mac: %s\n", describeMAC(md, err))
+	switch {
+	case err == nil:
+		fmt.Fprintln(w, "bound key: matches")
+	case errors.Is(err, ErrKeyMismatch):
+		// the storage key is authenticated along with the data, so a mismatch cannot be told from tampering
+		fmt.Fprintln(w, "bound key: mismatch, unless the data or its header was tampered with")
+	default:
+		fmt.Fprintln(w, "bound key: unverified, the data cannot be decrypted")
+	}
+	return nil
+}
+
+// writeKeyGroups writes the modification time and the key groups of the metadata.
+func writeKeyGroups(w io.Writer, md sops.Metadata) {
+	fmt.Fprintf(w, "last modified: %s\n", md.LastModified.Format(time.RFC3339))
+	if len(md.KeyGroups) > 1 {
+		threshold := md.ShamirThreshold
+		if threshold == 0 {
+			threshold = len(md.KeyGroups)
+		}
+		fmt.Fprintf(w, "key groups: %d, any %d of which decrypt the data\n", len(md.KeyGroups), threshold)
+	} else {
+		fmt.Fprintf(w, "key groups: %d\n", len(md.KeyGroups))
+	}
+	for i, group := range md.KeyGroups {
+		fmt.Fprintf(w, "  group %d:\n", i)
+		for _, mk := range group {
+			fmt.Fprintf(w, "    %s: %s\n", mk.TypeToIdentifier(), mk.ToString())
+		}
+	}
+}
+
+// describeMAC describes the validity of the MAC given the error of decrypting the data.
+func describeMAC(md sops.Metadata, err error) string {
+	switch {
+	case errors.Is(err, ErrMACMismatch):
+		return fmt.Sprintf("invalid, %v", err)
+	case err == nil, errors.Is(err, ErrKeyMismatch):
+		return "valid"
+	case errors.Is(err, ErrDecryption) && md.DataKey != nil:
+		return fmt.Sprintf("invalid, the data cannot be decrypted: %v", err)
+	default:
+		return fmt.Sprintf("unverified, %v", err)
+	}
+}
+
+// describeBinding describes the storage key the decrypted tree is bound to.
+func describeBinding(key string, tree sops.Tree, err error) string {
+	if err != nil && !errors.Is(err, ErrKeyMismatch) {
+		return "unverified, the data cannot be decrypted"
+	}
+	bound, ok := boundKey(tree.Branches)
+	switch {
+	case !ok:
+		return "none, stored by an earlier version"
+	case bound != key:
+		return fmt.Sprintf("mismatch, bound to %s", bound)
+	default:
+		return "matches"
+	}
+}
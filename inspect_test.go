@@ -0,0 +1,91 @@
+package encryptedstorage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestStorageInspect(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"shamir_threshold": 2, "encryption": [{"provider": "local", "keys": [%s, %s, %s]}]}`,
+		ageKey(recipient, ageId), ageKey(recipient2, ageId2), ageKey(recipient3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, key, []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	locked, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := s.inspect(ctx, key, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"key: " + key,
+		"key groups: 3, any 2 of which decrypt the data",
+		"  group 0:\n    age: " + recipient,
+		"  group 2:\n    age: " + recipient3,
+		"mac: valid",
+		"bound key: matches",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), val) {
+		t.Errorf("the output reveals the data:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := locked.inspect(ctx, key, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "mac: unverified") {
+		t.Errorf("expected the MAC to be unverified without the keys, got:\n%s", out.String())
+	}
+
+	raw, err := s.backend.Load(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.backend.Store(ctx, "swapped", raw); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := s.inspect(ctx, "swapped", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "mac: valid") || !strings.Contains(out.String(), "bound key: mismatch, bound to "+key) {
+		t.Errorf("expected the bound key to mismatch, got:\n%s", out.String())
+	}
+
+	tampered := regexp.MustCompile(`"lastmodified": "[^"]+"`).ReplaceAll(raw, []byte(`"lastmodified": "2000-01-01T00:00:00Z"`))
+	if err := s.backend.Store(ctx, key, tampered); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := s.inspect(ctx, key, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "mac: invalid") {
+		t.Errorf("expected the MAC to be invalid, got:\n%s", out.String())
+	}
+
+	if err := s.backend.Store(ctx, "plaintext", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.inspect(ctx, "plaintext", &out); err == nil {
+		t.Error("expected inspecting plaintext data to fail")
+	}
+}
@@ -0,0 +1,239 @@
+package encryptedstorage
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/credentials/local"
+	"google.golang.org/grpc/peer"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+)
+
+func init() {
+	caddy.RegisterModule(KeyService{})
+}
+
+// KeyService is a Caddy app serving an encryption provider as a SOPS key service over gRPC.
+// Other Caddy instances can then use the `remote` provider to offload the encryption/decryption
+// of the data keys to it, so only the host running the key service holds the credentials of the keys.
+type KeyService struct {
+	// The network addresses to listen on, in the form of Caddy network addresses, e.g.
+	// `:5000`, `tcp/10.0.0.1:5000`, or `unix//run/sops-keyservice.sock|0660`.
+	Listen []string `json:"listen,omitempty"`
+
+	// The encryption provider answering the requests. The provider must be
+	// capable of serving as a key service, e.g. `local`.
+	ProviderRaw json.RawMessage `json:"provider,omitempty" caddy:"namespace=caddy.storage.encrypted.provider inline_key=provider"`
+
+	// The TLS configuration of the server. Required for listening on TCP,
+	// unless `insecure` is set.
+	TLS *KeyServiceTLS `json:"tls,omitempty"`
+
+	// Serve over plaintext, without transport security. This exposes the data
+	// keys on the wire; only use it for local development.
+	Insecure bool `json:"insecure,omitempty"`
+
+	server    *grpc.Server
+	listeners []net.Listener
+	started   bool
+	logger    *zap.Logger
+}
+
+// KeyServiceTLS configures the TLS of the key service server
+type KeyServiceTLS struct {
+	// PEM-encoded certificate filename served by the key service.
+	CertificateFile string `json:"certificate_file,omitempty"`
+
+	// PEM-encoded key to use with the certificate.
+	CertificateKeyFile string `json:"certificate_key_file,omitempty"`
+
+	// Certificate authority module which provides the pool of certificates
+	// trusted to sign client certificates. If set, the clients must present
+	// a certificate signed by one of them.
+	ClientCARaw json.RawMessage `json:"client_ca,omitempty" caddy:"namespace=tls.ca_pool.source inline_key=provider"`
+}
+
+// CaddyModule implements caddy.Module.
+func (KeyService) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "sops_keyservice",
+		New: func() caddy.Module {
+			return new(KeyService)
+		},
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (ks *KeyService) Provision(ctx caddy.Context) error {
+	ks.logger = ctx.Logger()
+	if len(ks.Listen) == 0 {
+		return errors.New("field 'listen' cannot be empty")
+	}
+	if ks.ProviderRaw == nil {
+		return errors.New("field 'provider' cannot be empty")
+	}
+	if ks.TLS != nil && ks.Insecure {
+		return errors.New("fields 'tls' and 'insecure' are mutually exclusive")
+	}
+	iprovider, err := ctx.LoadModule(ks, "ProviderRaw")
+	if err != nil {
+		return err
+	}
+	srv, ok := iprovider.(keyservice.KeyServiceServer)
+	if !ok {
+		return fmt.Errorf("provider %T cannot serve as a key service", iprovider)
+	}
+
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	addrs := make([]caddy.NetworkAddress, 0, len(ks.Listen))
+	for _, l := range ks.Listen {
+		addr, err := caddy.ParseNetworkAddress(repl.ReplaceKnown(l, ""))
+		if err != nil {
+			return fmt.Errorf("parsing listen address '%s': %v", l, err)
+		}
+		if addr.PortRangeSize() != 1 {
+			return fmt.Errorf("listen address must be a single address: %s", l)
+		}
+		if !addr.IsUnixNetwork() && ks.TLS == nil && !ks.Insecure {
+			return fmt.Errorf("listening on %s requires either 'tls' or 'insecure'", addr)
+		}
+		addrs = append(addrs, addr)
+	}
+
+	creds, err := ks.transportCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	ks.server = grpc.NewServer(grpc.Creds(creds), grpc.UnaryInterceptor(ks.logRequest))
+	keyservice.RegisterKeyServiceServer(ks.server, srv)
+
+	for _, addr := range addrs {
+		ln, err := addr.Listen(ctx, 0, net.ListenConfig{})
+		if err != nil {
+			return fmt.Errorf("listening on %s: %v", addr, err)
+		}
+		nln, ok := ln.(net.Listener)
+		if !ok {
+			return fmt.Errorf("network '%s' is not a stream network", addr.Network)
+		}
+		ks.listeners = append(ks.listeners, nln)
+	}
+	return nil
+}
+
+func (ks *KeyService) transportCredentials(ctx caddy.Context) (credentials.TransportCredentials, error) {
+	if ks.Insecure {
+		return insecure.NewCredentials(), nil
+	}
+	if ks.TLS == nil {
+		// only Unix domain sockets are listened on, as validated by the caller
+		return local.NewCredentials(), nil
+	}
+	cfg, err := ks.TLS.makeTLSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+func (t *KeyServiceTLS) makeTLSConfig(ctx caddy.Context) (*tls.Config, error) {
+	if t.CertificateFile == "" || t.CertificateKeyFile == "" {
+		return nil, errors.New("fields 'certificate_file' and 'certificate_key_file' are required")
+	}
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	cert, err := tls.LoadX509KeyPair(repl.ReplaceKnown(t.CertificateFile, ""), repl.ReplaceKnown(t.CertificateKeyFile, ""))
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate key pair: %v", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if t.ClientCARaw != nil {
+		caRaw, err := ctx.LoadModule(t, "ClientCARaw")
+		if err != nil {
+			return nil, fmt.Errorf("loading client_ca module: %v", err)
+		}
+		ca, ok := caRaw.(caddytls.CA)
+		if !ok {
+			return nil, fmt.Errorf("CA module '%T' is not a certificate pool provider", caRaw)
+		}
+		cfg.ClientCAs = ca.CertPool()
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// logRequest is a gRPC interceptor logging the served requests.
+func (ks *KeyService) logRequest(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	resp, err := handler(ctx, req)
+	fields := []zap.Field{zap.String("method", info.FullMethod)}
+	if p, ok := peer.FromContext(ctx); ok {
+		fields = append(fields, zap.Stringer("remote_addr", p.Addr))
+	}
+	if err != nil {
+		ks.logger.Error("key service request failed", append(fields, zap.Error(err))...)
+	} else {
+		ks.logger.Debug("key service request served", fields...)
+	}
+	return resp, err
+}
+
+// Start implements caddy.App.
+func (ks *KeyService) Start() error {
+	ks.started = true
+	for _, ln := range ks.listeners {
+		ks.logger.Info("serving SOPS key service", zap.Stringer("address", ln.Addr()))
+		go func(ln net.Listener) {
+			if err := ks.server.Serve(ln); err != nil {
+				ks.logger.Error("key service stopped serving", zap.Stringer("address", ln.Addr()), zap.Error(err))
+			}
+		}(ln)
+	}
+	return nil
+}
+
+// Stop implements caddy.App.
+func (ks *KeyService) Stop() error {
+	ks.server.GracefulStop()
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (ks *KeyService) Cleanup() error {
+	// once started, the listeners are owned and closed by the gRPC server
+	if ks.started {
+		return nil
+	}
+	var errs []error
+	for _, ln := range ks.listeners {
+		if err := ln.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	_ caddy.Module       = (*KeyService)(nil)
+	_ caddy.Provisioner  = (*KeyService)(nil)
+	_ caddy.App          = (*KeyService)(nil)
+	_ caddy.CleanerUpper = (*KeyService)(nil)
+)
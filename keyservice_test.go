@@ -0,0 +1,82 @@
+package encryptedstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// startKeyServiceApp provisions and starts the `sops_keyservice` app with a `local` provider holding the age identity.
+func startKeyServiceApp(t *testing.T, config string) *KeyService {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	ks := new(KeyService)
+	if err := json.Unmarshal([]byte(config), ks); err != nil {
+		t.Fatal(err)
+	}
+	ks.ProviderRaw = json.RawMessage(fmt.Sprintf(`{"provider":"local", "keys": [{"type":"age", "recipient": "%s", "identities": ["%s"]}]}`, recipient, ageId))
+	if err := ks.Provision(ctx); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if err := ks.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(func() { _ = ks.Stop() })
+	return ks
+}
+
+func TestKeyServiceApp(t *testing.T) {
+	pki := newTestPKI(t)
+	keys := fmt.Sprintf(`[{"type":"age", "recipient": "%s"}]`, recipient)
+
+	t.Run("insecure", func(t *testing.T) {
+		ks := startKeyServiceApp(t, `{"listen": ["tcp/127.0.0.1:0"], "insecure": true}`)
+		addr := ks.listeners[0].Addr().String()
+		if err := roundTripRemote(t, fmt.Sprintf(`{"provider":"remote", "address": "%s", "insecure": true, "keys": %s}`, addr, keys)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("mutual tls", func(t *testing.T) {
+		ks := startKeyServiceApp(t, fmt.Sprintf(`{"listen": ["tcp/127.0.0.1:0"], "tls": {"certificate_file": %q, "certificate_key_file": %q, "client_ca": {"provider": "file", "pem_files": [%q]}}}`, pki.serverCertFile, pki.serverKeyFile, pki.caFile))
+		addr := ks.listeners[0].Addr().String()
+		ca := fmt.Sprintf(`"ca": {"provider": "file", "pem_files": [%q]}, "server_name": "keyservice.test"`, pki.caFile)
+		clientCert := fmt.Sprintf(`"client_certificate_file": %q, "client_certificate_key_file": %q`, pki.clientCertFile, pki.clientKeyFile)
+		if err := roundTripRemote(t, fmt.Sprintf(`{"provider":"remote", "address": "%s", "tls": {%s, %s}, "keys": %s}`, addr, ca, clientCert, keys)); err != nil {
+			t.Fatal(err)
+		}
+		if err := roundTripRemote(t, fmt.Sprintf(`{"provider":"remote", "address": "%s", "tls": {%s}, "keys": %s}`, addr, ca, keys)); err == nil {
+			t.Fatal("expected clients without certificate to be rejected")
+		}
+	})
+}
+
+func TestKeyServiceAppRequiresTransportSecurityOnTCP(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	ks := &KeyService{
+		Listen:      []string{"tcp/127.0.0.1:0"},
+		ProviderRaw: json.RawMessage(fmt.Sprintf(`{"provider":"local", "keys": [{"type":"age", "recipient": "%s", "identities": ["%s"]}]}`, recipient, ageId)),
+	}
+	if err := ks.Provision(ctx); err == nil {
+		t.Fatal("expected provisioning error")
+	}
+	if err := ks.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyServiceAppRejectsNonServingProvider(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	ks := &KeyService{
+		Listen:      []string{"unix//tmp/never-created.sock"},
+		ProviderRaw: json.RawMessage(fmt.Sprintf(`{"provider":"remote", "address": "127.0.0.1:5000", "insecure": true, "keys": [{"type":"age", "recipient": "%s"}]}`, recipient)),
+	}
+	if err := ks.Provision(ctx); err == nil {
+		t.Fatal("expected provisioning error")
+	}
+}
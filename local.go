@@ -16,7 +16,7 @@ import (
 	"github.com/getsops/sops/v3/age"
 	"github.com/getsops/sops/v3/azkv"
 	"github.com/getsops/sops/v3/gcpkms"
-	"github.com/getsops/sops/v3/hcvault"
+	"github.com/getsops/sops/v3/keys"
 	"github.com/getsops/sops/v3/keyservice"
 	"github.com/getsops/sops/v3/kms"
 	"github.com/getsops/sops/v3/pgp"
@@ -32,10 +32,22 @@ func init() {
 
 // Local encryption provider avails in-process encryption/decryption capabilities
 type Local struct {
-	// The encryption/decryption keyset
-	Keys       []json.RawMessage `json:"keys,omitempty" caddy:"namespace=caddy.storage.encrypted.key inline_key=type"`
+	// The encryption/decryption keyset. Each key is a key group of its own.
+	Keys []json.RawMessage `json:"keys,omitempty" caddy:"namespace=caddy.storage.encrypted.key inline_key=type"`
+
+	// The encryption/decryption keyset arranged into key groups. Any key
+	// of a key group can unlock the group.
+	KeyGroups  [][]json.RawMessage `json:"key_groups,omitempty" caddy:"namespace=caddy.storage.encrypted.key inline_key=type"`
 	keysGroups []sops.KeyGroup
 
+	// The keys only used for decryption, e.g. the retired keys during key rotation.
+	// The data written under them remains readable, while new data is encrypted
+	// with the other keys only.
+	LegacyKeys []json.RawMessage `json:"legacy_keys,omitempty" caddy:"namespace=caddy.storage.encrypted.key inline_key=type"`
+	legacyKeys []keys.MasterKey
+
+	keys []MasterkeyConverter
+
 	s keyservice.Server
 }
 
@@ -54,40 +66,86 @@ func (Local) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// KeyGroup implements KeyGroupGetter.
+// KeyGroup implements KeyGroupProvider.
 func (s *Local) KeyGroup() []sops.KeyGroup {
 	return s.keysGroups
 }
 
+// LegacyMasterkeys implements LegacyKeyProvider.
+func (s *Local) LegacyMasterkeys() []keys.MasterKey {
+	return s.legacyKeys
+}
+
+// masterkeys returns the master keys of the key groups and the legacy keys.
+func (s *Local) masterkeys() []keys.MasterKey {
+	var mks []keys.MasterKey
+	for _, kg := range s.keysGroups {
+		mks = append(mks, kg...)
+	}
+	return append(mks, s.legacyKeys...)
+}
+
 // Provision implements caddy.Provisioner.
 func (s *Local) Provision(ctx caddy.Context) error {
-	if len(s.Keys) == 0 {
-		return errors.New("field 'keys' cannot be empty")
-	}
-	iKeys, err := ctx.LoadModule(s, "Keys")
+	kgs, converters, err := loadKeyGroups(ctx, s, s.Keys, s.KeyGroups)
 	if err != nil {
 		return err
 	}
-	for _, iKey := range iKeys.([]any) {
-		key, ok := iKey.(MasterkeyConverter)
-		if !ok {
-			return fmt.Errorf("expected key to be of type sops.Key, but got %T", iKey)
-		}
-		s.keysGroups = append(s.keysGroups, sops.KeyGroup{key.ToMasterkey()})
+	s.keysGroups = kgs
+	legacyKeys, legacyConverters, err := loadLegacyKeys(ctx, s, s.LegacyKeys)
+	if err != nil {
+		return err
 	}
+	s.legacyKeys = legacyKeys
+	s.keys = append(converters, legacyConverters...)
 
 	return nil
 }
 
 // Encrypt implements keyservice.KeyServiceServer.
 func (s *Local) Encrypt(ctx context.Context, req *keyservice.EncryptRequest) (*keyservice.EncryptResponse, error) {
+	if c := s.keyCrypter(req.Key); c != nil {
+		ciphertext, err := c.encrypt(req.Plaintext)
+		if err != nil {
+			return nil, err
+		}
+		return &keyservice.EncryptResponse{
+			Ciphertext: ciphertext,
+		}, nil
+	}
+	if k := req.Key.GetVaultKey(); k != nil {
+		return nil, errUnknownVaultKey(k)
+	}
 	return s.s.Encrypt(ctx, req)
 }
 
+func errUnknownVaultKey(key *keyservice.VaultKey) error {
+	return fmt.Errorf("no 'hc_vault' key is configured for the key '%s' of the engine '%s' at '%s'", key.KeyName, key.EnginePath, key.VaultAddress)
+}
+
+// keyCrypter returns the configured key module handling the key, if any.
+func (s *Local) keyCrypter(key *keyservice.Key) keyCrypter {
+	for _, k := range s.keys {
+		if c, ok := k.(keyCrypter); ok && c.matches(key) {
+			return c
+		}
+	}
+	return nil
+}
+
 // Decrypt takes a decrypt request and decrypts the provided ciphertext with the provided key, returning the decrypted
 // result
 func (ks Local) Decrypt(ctx context.Context, req *keyservice.DecryptRequest) (*keyservice.DecryptResponse, error) {
 	key := req.Key
+	if c := ks.keyCrypter(key); c != nil {
+		plaintext, err := c.decrypt(req.Ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		return &keyservice.DecryptResponse{
+			Plaintext: plaintext,
+		}, nil
+	}
 	var response *keyservice.DecryptResponse
 	switch k := key.KeyType.(type) {
 	case *keyservice.Key_PgpKey:
@@ -161,17 +219,15 @@ func (ks *Local) decryptWithKms(key *keyservice.KmsKey, ciphertext []byte) ([]by
 }
 
 func (ks *Local) decryptWithGcpKms(key *keyservice.GcpKmsKey, ciphertext []byte) ([]byte, error) {
-	for _, kg := range ks.keysGroups {
-		for _, mk := range kg {
-			amk, ok := mk.(*gcpkms.MasterKey)
-			if !ok {
-				continue
-			}
-			gcpKey := *amk
-			gcpKey.EncryptedKey = string(ciphertext)
-			if res, err := gcpKey.Decrypt(); err == nil {
-				return res, nil
-			}
+	for _, mk := range ks.masterkeys() {
+		amk, ok := mk.(*gcpkms.MasterKey)
+		if !ok {
+			continue
+		}
+		gcpKey := *amk
+		gcpKey.EncryptedKey = string(ciphertext)
+		if res, err := gcpKey.Decrypt(); err == nil {
+			return res, nil
 		}
 	}
 	return nil, errors.New("cannot be decrypted")
@@ -188,29 +244,22 @@ func (ks *Local) decryptWithAzureKeyVault(key *keyservice.AzureKeyVaultKey, ciph
 	return plaintext, err
 }
 
+// decryptWithVault is reached only for the Vault keys no configured `hc_vault` key matches,
+// for which there are no credentials to authenticate to Vault with.
 func (ks *Local) decryptWithVault(key *keyservice.VaultKey, ciphertext []byte) ([]byte, error) {
-	vaultKey := hcvault.MasterKey{
-		VaultAddress: key.VaultAddress,
-		EnginePath:   key.EnginePath,
-		KeyName:      key.KeyName,
-	}
-	vaultKey.EncryptedKey = string(ciphertext)
-	plaintext, err := vaultKey.Decrypt()
-	return plaintext, err
+	return nil, errUnknownVaultKey(key)
 }
 
 func (ks *Local) decryptWithAge(key *keyservice.AgeKey, ciphertext []byte) ([]byte, error) {
-	for _, kg := range ks.keysGroups {
-		for _, mk := range kg {
-			amk, ok := mk.(*age.MasterKey)
-			if !ok {
-				continue
-			}
-			ageKey := *amk
-			ageKey.EncryptedKey = string(ciphertext)
-			if res, err := ageKey.Decrypt(); err == nil {
-				return res, nil
-			}
+	for _, mk := range ks.masterkeys() {
+		amk, ok := mk.(*age.MasterKey)
+		if !ok {
+			continue
+		}
+		ageKey := *amk
+		ageKey.EncryptedKey = string(ciphertext)
+		if res, err := ageKey.Decrypt(); err == nil {
+			return res, nil
 		}
 	}
 	return nil, errors.New("cannot be decrypted")
@@ -235,5 +284,6 @@ var (
 	_ caddy.Provisioner           = (*Local)(nil)
 	_ keyservice.KeyServiceServer = (*Local)(nil)
 	_ KeyGroupProvider            = (*Local)(nil)
+	_ LegacyKeyProvider           = (*Local)(nil)
 	_ KeyServiceClientProvider    = (*Local)(nil)
 )
@@ -0,0 +1,70 @@
+package encryptedstorage
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// reencryptions counts the data rewritten with the current key groups upon load.
+	reencryptions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_encrypted",
+		Name:      "reencryptions_total",
+		Help:      "Counter of the data re-encrypted with the current keys upon load.",
+	})
+
+	// plaintextLoads counts the plaintext data served upon load.
+	plaintextLoads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_encrypted",
+		Name:      "plaintext_loads_total",
+		Help:      "Counter of the plaintext data served upon load.",
+	})
+
+	// plaintextMigrations counts the plaintext data stored encrypted upon load.
+	plaintextMigrations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_encrypted",
+		Name:      "plaintext_migrations_total",
+		Help:      "Counter of the plaintext data stored encrypted upon load.",
+	})
+
+	// plaintextKeys counts the keys loaded as plaintext which remain plaintext. The plaintext
+	// data never loaded is not counted; `encrypted-storage rotate --dry-run` lists all of it.
+	plaintextKeys = &plaintextTracker{
+		keys: make(map[string]struct{}),
+		gauge: promauto.NewGauge(prometheus.GaugeOpts{
+			Namespace: "caddy",
+			Subsystem: "storage_encrypted",
+			Name:      "plaintext_loaded_unmigrated",
+			Help:      "Number of the keys loaded as plaintext since start which are not stored encrypted, e.g. for being outside of the migrated prefixes.",
+		}),
+	}
+)
+
+// plaintextTracker tracks the keys loaded as plaintext which failed to be stored encrypted.
+type plaintextTracker struct {
+	mu    sync.Mutex
+	keys  map[string]struct{}
+	gauge prometheus.Gauge
+}
+
+func (t *plaintextTracker) seen(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys[key] = struct{}{}
+	t.gauge.Set(float64(len(t.keys)))
+}
+
+func (t *plaintextTracker) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.keys[key]; !ok {
+		return
+	}
+	delete(t.keys, key)
+	t.gauge.Set(float64(len(t.keys)))
+}
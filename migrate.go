@@ -0,0 +1,101 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// migration copies the data of a storage into another under the same keys, e.g. into
+// an `encrypted` storage to encrypt the data, or out of it to decrypt the data.
+type migration struct {
+	from, to certmagic.Storage
+
+	// the key prefixes to skip
+	exclude []string
+
+	// where the progress is reported
+	out io.Writer
+}
+
+// migrationSummary is the outcome of a migration.
+type migrationSummary struct {
+	// the keys copied and verified
+	copied []string
+
+	// the keys skipped for matching the excluded prefixes
+	excluded []string
+
+	// the keys failed to copy along with the reason
+	failed map[string]error
+}
+
+func (m *migration) run(ctx context.Context) (*migrationSummary, error) {
+	keys, err := m.from.List(ctx, "", true)
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %v", err)
+	}
+	sort.Strings(keys)
+
+	summary := &migrationSummary{failed: make(map[string]error)}
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		if m.excluded(key) {
+			summary.excluded = append(summary.excluded, key)
+			continue
+		}
+		copied, err := m.copy(ctx, key)
+		switch {
+		case err != nil:
+			summary.failed[key] = err
+		case copied:
+			summary.copied = append(summary.copied, key)
+			fmt.Fprintf(m.out, "[%d/%d] copied: %s\n", i+1, len(keys), key)
+		}
+	}
+	return summary, nil
+}
+
+// copy copies the data of the key and verifies it is loaded back unchanged. It
+// reports whether the key holds data rather than being a directory.
+func (m *migration) copy(ctx context.Context, key string) (bool, error) {
+	info, err := m.from.Stat(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if !info.IsTerminal {
+		return false, nil
+	}
+	data, err := m.from.Load(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("loading: %v", err)
+	}
+	if err := m.to.Store(ctx, key, data); err != nil {
+		return false, fmt.Errorf("storing: %v", err)
+	}
+	stored, err := m.to.Load(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("verifying: %v", err)
+	}
+	if !bytes.Equal(stored, data) {
+		return false, errors.New("verifying: the data loaded back differs from the original")
+	}
+	return true, nil
+}
+
+func (m *migration) excluded(key string) bool {
+	for _, prefix := range m.exclude {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,13 @@
 package encryptedstorage
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/certmagic"
@@ -15,6 +18,8 @@ import (
 	"github.com/getsops/sops/v3/keyservice"
 	jsonstore "github.com/getsops/sops/v3/stores/json"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/caddyserver/caddy/v2"
 )
@@ -29,12 +34,33 @@ type MasterkeyConverter interface {
 	ToMasterkey() keys.MasterKey
 }
 
+// MasterkeysConverter allows conversion from the custom key type
+// to several SOPS `keys.MasterKey`, e.g. a key type of multiple
+// recipients. Any of the master keys can unlock the key group.
+type MasterkeysConverter interface {
+	ToMasterkeys() []keys.MasterKey
+}
+
+// masterkeys returns the master keys of the key module.
+func masterkeys(key MasterkeyConverter) []keys.MasterKey {
+	if mks, ok := key.(MasterkeysConverter); ok {
+		return mks.ToMasterkeys()
+	}
+	return []keys.MasterKey{key.ToMasterkey()}
+}
+
 // KeyGroupProvider allows the `encrypted` storage module to
 // obtain the keys from the encryption provider
 type KeyGroupProvider interface {
 	KeyGroup() []sops.KeyGroup
 }
 
+// LegacyKeyProvider allows the `encrypted` storage module to
+// obtain the decrypt-only keys of the encryption provider
+type LegacyKeyProvider interface {
+	LegacyMasterkeys() []keys.MasterKey
+}
+
 // KeyServiceClientProvider allows the `encrypted` storage module
 // to obtain the encryption/decryption client conforming to the
 // provider.
@@ -42,6 +68,90 @@ type KeyServiceClientProvider interface {
 	KeyServiceClient() keyservice.KeyServiceClient
 }
 
+// loadLegacyKeys loads the `LegacyKeys` field of the given provider struct pointer. The legacy keys are
+// only used to decrypt the existing data, e.g. written under retired keys, and never to encrypt new data.
+func loadLegacyKeys(ctx caddy.Context, provider any, legacyKeys []json.RawMessage) ([]keys.MasterKey, []MasterkeyConverter, error) {
+	if len(legacyKeys) == 0 {
+		return nil, nil, nil
+	}
+	iKeys, err := ctx.LoadModule(provider, "LegacyKeys")
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		mks        []keys.MasterKey
+		converters []MasterkeyConverter
+	)
+	for _, iKey := range iKeys.([]any) {
+		key, ok := iKey.(MasterkeyConverter)
+		if !ok {
+			return nil, nil, fmt.Errorf("expected key to be of type sops.Key, but got %T", iKey)
+		}
+		converters = append(converters, key)
+		mks = append(mks, masterkeys(key)...)
+	}
+	return mks, converters, nil
+}
+
+// keyCrypter is implemented by the key modules encrypting/decrypting the
+// data key with their configured settings rather than the SOPS defaults,
+// e.g. key material given in the config instead of the host's keyring.
+type keyCrypter interface {
+	// matches reports whether the SOPS key is of the key module.
+	matches(key *keyservice.Key) bool
+	encrypt(dataKey []byte) ([]byte, error)
+	decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// loadKeyGroups loads the `Keys` and `KeyGroups` fields of the given provider struct pointer as SOPS key groups.
+// Each of the `Keys` is placed in a key group of its own, while each of the `KeyGroups` is a key group of the
+// listed keys, any of which can unlock the group. The loaded key modules are returned alongside the groups.
+func loadKeyGroups(ctx caddy.Context, provider any, keys []json.RawMessage, keyGroups [][]json.RawMessage) ([]sops.KeyGroup, []MasterkeyConverter, error) {
+	if len(keys) == 0 && len(keyGroups) == 0 {
+		return nil, nil, errors.New("either field 'keys' or 'key_groups' must be specified")
+	}
+	var (
+		groups     []sops.KeyGroup
+		converters []MasterkeyConverter
+	)
+	if len(keys) > 0 {
+		iKeys, err := ctx.LoadModule(provider, "Keys")
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, iKey := range iKeys.([]any) {
+			key, ok := iKey.(MasterkeyConverter)
+			if !ok {
+				return nil, nil, fmt.Errorf("expected key to be of type sops.Key, but got %T", iKey)
+			}
+			converters = append(converters, key)
+			groups = append(groups, sops.KeyGroup(masterkeys(key)))
+		}
+	}
+	if len(keyGroups) > 0 {
+		iGroups, err := ctx.LoadModule(provider, "KeyGroups")
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, iGroup := range iGroups.([][]any) {
+			if len(iGroup) == 0 {
+				return nil, nil, fmt.Errorf("key group %d cannot be empty", i)
+			}
+			group := make(sops.KeyGroup, 0, len(iGroup))
+			for _, iKey := range iGroup {
+				key, ok := iKey.(MasterkeyConverter)
+				if !ok {
+					return nil, nil, fmt.Errorf("expected key to be of type sops.Key, but got %T", iKey)
+				}
+				converters = append(converters, key)
+				group = append(group, masterkeys(key)...)
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups, converters, nil
+}
+
 // Storage is the impelementation of certmagic.Storage interface for Caddy with encryption/decryption layer
 // using [SOPS](https://github.com/getsops/sops). The module accepts any Caddy storage module as the backend.
 type Storage struct {
@@ -49,15 +159,59 @@ type Storage struct {
 	RawBackend json.RawMessage `json:"backend,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
 	backend    certmagic.Storage
 
-	// The encryption provider: local, remote. Although this is an array, current support is for 1 provider.
-	// TODO: implemented the `remote` provider.
-	// TODO: multiple providers
+	// The encryption providers: local, remote. The key groups of all the providers are
+	// written into each file, and each key is encrypted/decrypted through the key service
+	// of the provider it is configured in, falling back to the other providers in order.
 	Encryption        []json.RawMessage `json:"encryption,omitempty" caddy:"namespace=caddy.storage.encrypted.provider inline_key=provider"`
 	keyServiceClients []keyservice.KeyServiceClient
 	keyGroups         []sops.KeyGroup
 
-	store  sops.Store
-	logger *zap.Logger
+	// The number of key groups required to decrypt the data, when the providers
+	// have more than one key group in total. The data key is split among the key
+	// groups using Shamir's Secret Sharing. Default: all the key groups.
+	ShamirThreshold int `json:"shamir_threshold,omitempty"`
+
+	// Rewrite the loaded data with the current key groups when it was encrypted
+	// with different ones or another Shamir threshold, e.g. after key rotation, so
+	// the stored data converges to the current keys without waiting for it to be
+	// renewed. The loaded data not bound to its storage key, when allowed, is
+	// rewritten to be bound. The data is rewritten in the background, so loading
+	// does not wait for it.
+	ReencryptOnLoad bool `json:"reencrypt_on_load,omitempty"`
+
+	// Serve the plaintext data of the backend, e.g. persisted before enabling
+	// encryption, as-is and store it encrypted in the background upon load.
+	// Otherwise, loading plaintext data fails.
+	MigratePlaintext *PlaintextMigration `json:"migrate_plaintext,omitempty"`
+
+	// Fail to load the data which is not bound to its storage key, i.e. stored by the
+	// earlier versions of this module, which can be copied over another key without
+	// failing to load. Enable once the existing data is bound, e.g. rotated with the
+	// `encrypted-storage rotate` command. Default: the unbound data is loaded with a
+	// warning, and rewritten bound to its key in the background.
+	RequireBoundData bool `json:"require_bound_data,omitempty"`
+
+	// Obfuscate the key names in the backend, so the names, e.g. of the served
+	// domains, are not revealed to whoever can read the backend.
+	ObfuscateNames *NameObfuscation `json:"obfuscate_names,omitempty"`
+
+	// The format of the stored data: `sops`, the SOPS JSON document, or `envelope`, a compact
+	// binary envelope of the data encrypted with the data key, which is wrapped with the same
+	// key groups as SOPS does. The data stored in either format is loaded. Default: `sops`.
+	Format string `json:"format,omitempty"`
+
+	// The content cipher of the `envelope` format: `aes-256-gcm` or `xchacha20-poly1305`.
+	// Default: `aes-256-gcm`.
+	Cipher string `json:"cipher,omitempty"`
+
+	// The policies of the keys, evaluated in order, e.g. to store the public data in
+	// plaintext or to encrypt the private keys with other providers. The first matching
+	// policy applies, and the keys matching none are encrypted with the storage providers.
+	Policies []*Policy `json:"policies,omitempty"`
+
+	store    sops.Store
+	rewrites *rewriteQueue
+	logger   *zap.Logger
 }
 
 // CaddyModule implements caddy.Module.
@@ -85,30 +239,127 @@ func (s *Storage) Provision(ctx caddy.Context) error {
 	if len(s.Encryption) == 0 {
 		return fmt.Errorf("field 'encryption' cannot be empty")
 	}
-	if len(s.Encryption) > 1 {
-		return fmt.Errorf("only 1 provider is supported")
-	}
 	iencrypt, err := ctx.LoadModule(s, "Encryption")
 	if err != nil {
 		return err
 	}
-	for _, iface := range iencrypt.([]any) {
-		if clp, ok := iface.(KeyServiceClientProvider); ok {
-			s.keyServiceClients = append(s.keyServiceClients, clp.KeyServiceClient())
-		}
-		if kgp, ok := iface.(KeyGroupProvider); ok {
-			s.keyGroups = append(s.keyGroups, kgp.KeyGroup()...)
+	var router keyServiceRouter
+	s.keyGroups, router = loadProviders(iencrypt.([]any))
+	if err := validateShamirThreshold(s.ShamirThreshold, len(s.keyGroups)); err != nil {
+		return err
+	}
+	// the data encrypted by any of the policies is decrypted through the providers of
+	// all of them, so the data stays readable when the policies change
+	for i, p := range s.Policies {
+		r, err := p.provision(ctx)
+		if err != nil {
+			return fmt.Errorf("policy %d: %v", i, err)
 		}
+		router = append(router, r...)
+	}
+	if len(router) > 0 {
+		s.keyServiceClients = []keyservice.KeyServiceClient{router}
 	}
 
 	s.store = &jsonstore.BinaryStore{}
 
+	switch s.Format {
+	case "":
+		s.Format = formatSOPS
+	case formatSOPS, formatEnvelope:
+	default:
+		return fmt.Errorf("unrecognized format '%s'", s.Format)
+	}
+	if s.Cipher != "" && s.Format != formatEnvelope {
+		return fmt.Errorf("field 'cipher' is only allowed with the '%s' format", formatEnvelope)
+	}
+	if s.Cipher == "" {
+		s.Cipher = cipherAESGCM
+	}
+	if _, ok := envelopeCiphers[s.Cipher]; !ok {
+		return fmt.Errorf("unrecognized cipher '%s'", s.Cipher)
+	}
+
+	if s.ObfuscateNames != nil {
+		if s.MigratePlaintext != nil {
+			return errors.New("fields 'migrate_plaintext' and 'obfuscate_names' are mutually exclusive; migrate the plaintext data with the 'encrypted-storage migrate' command instead")
+		}
+		repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if !ok {
+			repl = caddy.NewReplacer()
+		}
+		secret := repl.ReplaceKnown(s.ObfuscateNames.Secret, "")
+		if len(secret) < 16 {
+			return errors.New("field 'secret' of 'obfuscate_names' must be at least 16 bytes long")
+		}
+		s.backend = newObfuscatedStorage(s, s.backend, []byte(secret))
+	}
+	s.rewrites = newRewriteQueue(s.logger)
+
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper. The rewrites of the loaded data still queued are dropped.
+func (s *Storage) Cleanup() error {
+	if s.rewrites != nil {
+		s.rewrites.stop()
+	}
+	return nil
+}
+
+// loadProviders returns the key groups of the loaded encryption providers, and
+// the router of their key service clients along with the keys of each.
+func loadProviders(providers []any) ([]sops.KeyGroup, keyServiceRouter) {
+	var (
+		groups []sops.KeyGroup
+		router keyServiceRouter
+	)
+	for _, iface := range providers {
+		var pks providerKeyService
+		if kgp, ok := iface.(KeyGroupProvider); ok {
+			kgs := kgp.KeyGroup()
+			groups = append(groups, kgs...)
+			for _, kg := range kgs {
+				for _, mk := range kg {
+					k := keyservice.KeyFromMasterKey(mk)
+					pks.keys = append(pks.keys, &k)
+				}
+			}
+		}
+		if lkp, ok := iface.(LegacyKeyProvider); ok {
+			for _, mk := range lkp.LegacyMasterkeys() {
+				k := keyservice.KeyFromMasterKey(mk)
+				pks.keys = append(pks.keys, &k)
+			}
+		}
+		if clp, ok := iface.(KeyServiceClientProvider); ok {
+			pks.client = clp.KeyServiceClient()
+			router = append(router, pks)
+		}
+	}
+	return groups, router
+}
+
+// validateShamirThreshold validates the Shamir threshold against the number of key groups.
+func validateShamirThreshold(threshold, groups int) error {
+	switch {
+	case threshold == 0:
+		return nil
+	case groups < 2:
+		return errors.New("field 'shamir_threshold' requires more than one key group")
+	case threshold < 2 || threshold > groups:
+		return fmt.Errorf("field 'shamir_threshold' must be between 2 and the number of key groups (%d); for any single key to decrypt, place the keys in the same key group", groups)
+	}
 	return nil
 }
 
 // Delete implements certmagic.Storage.
 func (s *Storage) Delete(ctx context.Context, key string) error {
-	return s.backend.Delete(ctx, key)
+	if err := s.backend.Delete(ctx, key); err != nil {
+		return err
+	}
+	plaintextKeys.forget(key)
+	return nil
 }
 
 // Exists implements certmagic.Storage.
@@ -123,75 +374,350 @@ func (s *Storage) List(ctx context.Context, path string, recursive bool) ([]stri
 
 // Load implements certmagic.Storage.
 func (s *Storage) Load(ctx context.Context, key string) ([]byte, error) {
+	policy := s.policy(key)
+	if policy.action() == actionDeny {
+		return nil, fmt.Errorf("%w: loading %s", ErrDenied, key)
+	}
 	bs, err := s.backend.Load(ctx, key)
 	if err != nil {
-		return bs, fmt.Errorf("backend load error: %s", err)
+		return bs, fmt.Errorf("backend load error: %w", err)
+	}
+
+	if isEnvelope(bs) {
+		plaintext, md, err := s.openEnvelope(key, bs)
+		if err != nil {
+			return nil, err
+		}
+		groups, threshold := s.keyGroupsOf(key)
+		if s.ReencryptOnLoad && policy.action() == actionEncrypt && (s.Format != formatEnvelope || !encryptedWith(md, groups, threshold)) {
+			s.reencrypt(key, bs, plaintext)
+		}
+		return plaintext, nil
 	}
 
 	tree, err := s.store.LoadEncryptedFile(bs)
 	if err != nil {
-		return nil, fmt.Errorf("error loading encrypted file: %s", err)
+		if isPlaintext(bs, err) {
+			if policy.action() == actionPlaintext {
+				return bs, nil
+			}
+			if plaintext, ok := s.loadPlaintext(key, bs); ok {
+				return plaintext, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: error loading encrypted file: %v", ErrMalformed, err)
 	}
 	tree.FilePath = key
+	if err := s.decryptTree(&tree); err != nil {
+		return nil, err
+	}
+
+	plaintext, err := s.store.EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	_, bound := boundKey(tree.Branches)
+	groups, threshold := s.keyGroupsOf(key)
+	if !bound {
+		s.logger.Warn("loaded data not bound to its key, stored by an earlier version", zap.String("key", key))
+	}
+	if policy.action() == actionEncrypt && (!bound || s.ReencryptOnLoad && (s.Format != formatSOPS || !encryptedWith(tree.Metadata, groups, threshold))) {
+		s.reencrypt(key, bs, plaintext)
+	}
+	return plaintext, nil
+}
 
-	_, err = common.DecryptTree(common.DecryptTreeOpts{
-		Tree:        &tree,
-		KeyServices: s.keyServiceClients,
-		IgnoreMac:   false,
-		Cipher:      aes.NewCipher(),
+// reencrypt queues the rewrite of the loaded data with the current key groups and format,
+// unless changed in the meantime.
+func (s *Storage) reencrypt(key string, outdated, plaintext []byte) {
+	plaintext = bytes.Clone(plaintext)
+	s.rewrites.enqueue(key, func(ctx context.Context) {
+		stored, err := s.rewrite(ctx, key, outdated, plaintext)
+		if err != nil {
+			s.logger.Error("failed to re-encrypt with the current keys", zap.String("key", key), zap.Error(err))
+		} else if stored {
+			reencryptions.Inc()
+			s.logger.Info("re-encrypted with the current keys", zap.String("key", key))
+		}
+	})
+}
+
+// loadPlaintext returns the data of the key as-is when it is plaintext, e.g. persisted before
+// enabling encryption, and migration of the key is enabled. The data is then stored encrypted
+// in the background.
+func (s *Storage) loadPlaintext(key string, bs []byte) ([]byte, bool) {
+	if s.MigratePlaintext == nil {
+		return nil, false
+	}
+	if !s.MigratePlaintext.covers(key) {
+		plaintextKeys.seen(key)
+		return nil, false
+	}
+	plaintextLoads.Inc()
+	outdated := bytes.Clone(bs)
+	s.rewrites.enqueue(key, func(ctx context.Context) {
+		stored, err := s.rewrite(ctx, key, outdated, outdated)
+		switch {
+		case err != nil:
+			plaintextKeys.seen(key)
+			s.logger.Error("failed to migrate plaintext data", zap.String("key", key), zap.Error(err))
+		case stored:
+			plaintextMigrations.Inc()
+			s.logger.Info("migrated plaintext data", zap.String("key", key))
+		}
 	})
+	return bs, true
+}
+
+// rewrite stores the plaintext under the current key groups while holding the lock of the key, unless the
+// outdated data, e.g. encrypted under other key groups, has been changed in the meantime. It reports whether
+// the plaintext is stored.
+func (s *Storage) rewrite(ctx context.Context, key string, outdated, plaintext []byte) (bool, error) {
+	if err := s.backend.Lock(ctx, key); err != nil {
+		return false, fmt.Errorf("acquiring lock: %v", err)
+	}
+	defer func() {
+		if err := s.backend.Unlock(ctx, key); err != nil {
+			s.logger.Error("failed to release lock", zap.String("key", key), zap.Error(err))
+		}
+	}()
+	current, err := s.backend.Load(ctx, key)
 	if err != nil {
-		return nil, fmt.Errorf("error decrypting tree: %s", err)
+		return false, fmt.Errorf("backend load error: %w", err)
+	}
+	if !bytes.Equal(current, outdated) {
+		return false, nil
+	}
+	if err := s.Store(ctx, key, plaintext); err != nil {
+		return false, err
 	}
+	return true, nil
+}
+
+// isPlaintext reports whether the data, failed to load as an encrypted file, is
+// plaintext rather than corrupted encrypted data.
+func isPlaintext(bs []byte, err error) bool {
+	if errors.Is(err, sops.MetadataNotFound) {
+		return true
+	}
+	return !json.Valid(bs) && !bytes.Contains(bs, []byte(`"sops"`))
+}
+
+// copyKeyGroups returns a copy of the key groups with a copy of each master key. Generating
+// the data key writes the wrapped data key into the master keys of the metadata, so each
+// encryption needs its own master keys, rather than sharing those of the providers.
+func copyKeyGroups(groups []sops.KeyGroup) []sops.KeyGroup {
+	copied := make([]sops.KeyGroup, len(groups))
+	for i, group := range groups {
+		copied[i] = make(sops.KeyGroup, len(group))
+		for j, mk := range group {
+			v := reflect.ValueOf(mk)
+			if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+				copied[i][j] = mk
+				continue
+			}
+			c := reflect.New(v.Elem().Type())
+			c.Elem().Set(v.Elem())
+			copied[i][j] = c.Interface().(keys.MasterKey)
+		}
+	}
+	return copied
+}
 
-	return s.store.EmitPlainFile(tree.Branches)
+// encryptedWith reports whether the data of the metadata is encrypted with the key groups
+// and the Shamir threshold, where a threshold of zero requires all the key groups.
+func encryptedWith(md sops.Metadata, groups []sops.KeyGroup, threshold int) bool {
+	if !keyGroupsEqual(md.KeyGroups, groups) {
+		return false
+	}
+	stored := md.ShamirThreshold
+	if stored == 0 {
+		stored = len(md.KeyGroups)
+	}
+	if threshold == 0 {
+		threshold = len(groups)
+	}
+	return stored == threshold
 }
 
-// Stat implements certmagic.Storage.
+// keyGroupsEqual reports whether both have the same keys in the same key groups,
+// regardless of the order of the key groups and of the keys within each group.
+func keyGroupsEqual(a, b []sops.KeyGroup) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	matched := make([]bool, len(b))
+	for _, ga := range a {
+		found := false
+		for j, gb := range b {
+			if !matched[j] && keyGroupEqual(ga, gb) {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func keyGroupEqual(a, b sops.KeyGroup) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, mka := range a {
+		ka := keyservice.KeyFromMasterKey(mka)
+		found := false
+		for _, mkb := range b {
+			kb := keyservice.KeyFromMasterKey(mkb)
+			if proto.Equal(&ka, &kb) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Stat implements certmagic.Storage. The size is of the plaintext data and the modification time is
+// of the encryption. Data which is not encrypted, e.g. plaintext to be migrated, is reported as-is, and
+// so is the size of the data stored before the plaintext size was recorded. The data is never decrypted.
 func (s *Storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	return s.backend.Stat(ctx, key)
+	if s.policy(key).action() == actionDeny {
+		return certmagic.KeyInfo{}, fmt.Errorf("%w: stat %s", ErrDenied, key)
+	}
+	info, err := s.backend.Stat(ctx, key)
+	if err != nil || !info.IsTerminal {
+		return info, err
+	}
+	bs, err := s.backend.Load(ctx, key)
+	if err != nil {
+		return info, fmt.Errorf("backend load error: %w", err)
+	}
+	if isEnvelope(bs) {
+		e, err := parseEnvelope(bs)
+		if err != nil {
+			return info, err
+		}
+		info.Modified = e.metadata.LastModified
+		info.Size = e.plaintextSize()
+		return info, nil
+	}
+	tree, err := s.store.LoadEncryptedFile(bs)
+	if err != nil {
+		return info, nil
+	}
+	info.Modified = tree.Metadata.LastModified
+	if size, ok := plaintextSize(tree.Branches); ok {
+		info.Size = size
+	}
+	return info, nil
 }
 
 // Store implements certmagic.Storage.
 func (s *Storage) Store(ctx context.Context, key string, value []byte) error {
-	branches, err := s.store.LoadPlainFile(value)
-	if err != nil {
+	switch s.policy(key).action() {
+	case actionDeny:
+		return fmt.Errorf("%w: storing %s", ErrDenied, key)
+	case actionPlaintext:
+		if err := s.backend.Store(ctx, key, value); err != nil {
+			return fmt.Errorf("backend store error: %w", err)
+		}
+		plaintextKeys.forget(key)
 		return nil
 	}
 
+	encryptedFile, err := s.encrypt(key, value)
+	if err != nil {
+		return err
+	}
+
+	if err := s.backend.Store(ctx, key, encryptedFile); err != nil {
+		return fmt.Errorf("backend store error: %w", err)
+	}
+	plaintextKeys.forget(key)
+	return nil
+}
+
+// decryptTree decrypts the loaded tree in place with the data key unlocked through the key services,
+// and verifies the MAC of the tree and that the tree is bound to its storage key, i.e. `tree.FilePath`.
+func (s *Storage) decryptTree(tree *sops.Tree) error {
+	keyServices, unavailable := s.observeKeyServices()
+	dataKey, err := tree.Metadata.GetDataKeyWithKeyServices(keyServices, nil)
+	if err != nil {
+		if unavailable.Load() {
+			return fmt.Errorf("%w: could not decrypt data key: %v", ErrKeyServiceUnavailable, err)
+		}
+		return fmt.Errorf("%w: could not decrypt data key: %v", ErrDecryption, err)
+	}
+	cipher := aes.NewCipher()
+	computedMac, err := tree.Decrypt(dataKey, cipher)
+	if err != nil {
+		return fmt.Errorf("%w: error decrypting tree: %v", ErrDecryption, err)
+	}
+	fileMac, err := cipher.Decrypt(tree.Metadata.MessageAuthenticationCode, dataKey, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("%w: cannot decrypt MAC: %v", ErrMACMismatch, err)
+	}
+	if fileMac != computedMac {
+		return fmt.Errorf("%w: file has %s, computed %s", ErrMACMismatch, fileMac, computedMac)
+	}
+	bound, ok := boundKey(tree.Branches)
+	if !ok && s.RequireBoundData {
+		return fmt.Errorf("%w: the data is not bound to its key; bind it with the 'encrypted-storage rotate' command, or unset 'require_bound_data'", ErrKeyMismatch)
+	}
+	if ok && bound != tree.FilePath {
+		return fmt.Errorf("%w: the data is bound to the key %q", ErrKeyMismatch, bound)
+	}
+	return nil
+}
+
+// encryptBranches encrypts the branches with a newly generated data key, which is encrypted
+// with the current key groups of the key, e.g. of its policy, and returns the encrypted file.
+func (s *Storage) encryptBranches(key string, branches sops.TreeBranches) ([]byte, error) {
 	if len(branches) < 1 {
-		return errors.New("file cannot be completely empty, it must contain at least one document")
+		return nil, fmt.Errorf("%w: file cannot be completely empty, it must contain at least one document", ErrMalformed)
 	}
 
 	cipher := aes.NewCipher()
 
+	groups, threshold := s.keyGroupsOf(key)
 	tree := sops.Tree{
-		Branches: branches,
+		Branches: withAttributes(key, branches),
 		Metadata: sops.Metadata{
-			LastModified: time.Now().UTC(),
-			KeyGroups:    s.keyGroups,
+			LastModified:      time.Now().UTC(),
+			KeyGroups:         copyKeyGroups(groups),
+			ShamirThreshold:   threshold,
+			UnencryptedSuffix: sops.DefaultUnencryptedSuffix,
 		},
 		FilePath: key,
 	}
 
-	dataKey, errs := tree.GenerateDataKeyWithKeyServices(s.keyServiceClients)
+	keyServices, unavailable := s.observeKeyServices()
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices(keyServices)
 	if len(errs) > 0 {
-		return fmt.Errorf("could not generate data key: %s", errs)
+		if unavailable.Load() {
+			return nil, fmt.Errorf("%w: could not generate data key: %s", ErrKeyServiceUnavailable, errs)
+		}
+		return nil, fmt.Errorf("%w: could not generate data key: %s", ErrEncryption, errs)
 	}
 	if err := common.EncryptTree(common.EncryptTreeOpts{
 		Tree:    &tree,
 		Cipher:  cipher,
 		DataKey: dataKey,
 	}); err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %v", ErrEncryption, err)
 	}
 
 	encryptedFile, err := s.store.EmitEncryptedFile(tree)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %v", ErrEncryption, err)
 	}
-
-	return s.backend.Store(ctx, key, encryptedFile)
+	return encryptedFile, nil
 }
 
 // Lock implements certmagic.Storage.
@@ -204,9 +730,157 @@ func (s *Storage) Unlock(ctx context.Context, name string) error {
 	return s.backend.Unlock(ctx, name)
 }
 
+const (
+	// sizeKey is the key of the plaintext size in the tree. It is left unencrypted
+	// for `Stat` to read without decrypting the data, yet it is covered by the MAC.
+	sizeKey = "size" + sops.DefaultUnencryptedSuffix
+
+	// boundKeyKey is the key of the storage key the data is stored under in the tree.
+	// It is encrypted and covered by the MAC, binding the data to its storage key, so
+	// the data copied over another key fails to load.
+	boundKeyKey = "key"
+)
+
+// withAttributes records the size of the data and the storage key in the branches.
+func withAttributes(key string, branches sops.TreeBranches) sops.TreeBranches {
+	branch := make(sops.TreeBranch, 0, len(branches[0])+2)
+	size := -1
+	for _, item := range branches[0] {
+		if item.Key == sizeKey || item.Key == boundKeyKey {
+			continue
+		}
+		if data, ok := item.Value.(string); ok && item.Key == "data" {
+			size = len(data)
+		}
+		branch = append(branch, item)
+	}
+	branch = append(branch, sops.TreeItem{Key: boundKeyKey, Value: key})
+	if size >= 0 {
+		branch = append(branch, sops.TreeItem{Key: sizeKey, Value: size})
+	}
+	return append(sops.TreeBranches{branch}, branches[1:]...)
+}
+
+// boundKey returns the storage key recorded in the decrypted branches, if any.
+func boundKey(branches sops.TreeBranches) (string, bool) {
+	if len(branches) == 0 {
+		return "", false
+	}
+	for _, item := range branches[0] {
+		if key, ok := item.Value.(string); ok && item.Key == boundKeyKey {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// plaintextSize returns the size of the data recorded in the branches, if any.
+func plaintextSize(branches sops.TreeBranches) (int64, bool) {
+	if len(branches) == 0 {
+		return 0, false
+	}
+	for _, item := range branches[0] {
+		if item.Key != sizeKey {
+			continue
+		}
+		switch size := item.Value.(type) {
+		case int:
+			return int64(size), true
+		case int64:
+			return size, true
+		case float64:
+			return int64(size), true
+		}
+	}
+	return 0, false
+}
+
+// PlaintextMigration configures the migration of the plaintext data upon load.
+type PlaintextMigration struct {
+	// The key prefixes, e.g. `certificates/`, of the plaintext data to migrate.
+	// Default: all the keys.
+	PathPrefixes []string `json:"path_prefixes,omitempty"`
+}
+
+// covers reports whether the plaintext data of the key is to be migrated.
+func (m *PlaintextMigration) covers(key string) bool {
+	if len(m.PathPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range m.PathPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// providerKeyService is the key service client of an encryption provider along with the keys configured in it.
+type providerKeyService struct {
+	client keyservice.KeyServiceClient
+	keys   []*keyservice.Key
+}
+
+func (p providerKeyService) owns(key *keyservice.Key) bool {
+	for _, k := range p.keys {
+		if proto.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyServiceRouter is a key service client dispatching each request to the key service of the
+// provider owning the requested key first, then to the rest of the providers in their configured order.
+type keyServiceRouter []providerKeyService
+
+func (r keyServiceRouter) ordered(key *keyservice.Key) []keyservice.KeyServiceClient {
+	clients := make([]keyservice.KeyServiceClient, 0, len(r))
+	for _, p := range r {
+		if p.owns(key) {
+			clients = append(clients, p.client)
+		}
+	}
+	for _, p := range r {
+		if !p.owns(key) {
+			clients = append(clients, p.client)
+		}
+	}
+	return clients
+}
+
+// Encrypt implements keyservice.KeyServiceClient.
+func (r keyServiceRouter) Encrypt(ctx context.Context, in *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	var errs []error
+	for _, c := range r.ordered(in.Key) {
+		resp, err := c.Encrypt(ctx, in, opts...)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Decrypt implements keyservice.KeyServiceClient.
+func (r keyServiceRouter) Decrypt(ctx context.Context, in *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	var errs []error
+	for _, c := range r.ordered(in.Key) {
+		resp, err := c.Decrypt(ctx, in, opts...)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
 var (
 	_ caddy.Module           = (*Storage)(nil)
 	_ caddy.Provisioner      = (*Storage)(nil)
+	_ caddy.CleanerUpper     = (*Storage)(nil)
 	_ certmagic.Storage      = (*Storage)(nil)
 	_ caddy.StorageConverter = (*Storage)(nil)
+
+	_ keyservice.KeyServiceClient = (keyServiceRouter)(nil)
 )
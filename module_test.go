@@ -4,15 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddytest"
 	_ "github.com/caddyserver/caddy/v2/modules/standard"
-	"github.com/caddyserver/certmagic"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
 	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/keys"
+	"google.golang.org/grpc"
 )
 
 func must(k *age.MasterKey, e error) *age.MasterKey {
@@ -28,6 +37,11 @@ const (
 	recipient = "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2"
 	ageId     = "AGE-SECRET-KEY-16E6P6H93CXNPZQRJVNA5NMK4X06ZHCDU4ED9U89E3PZMASSMC46SX99PEW"
 	dataDir   = "test-ground"
+
+	recipient2 = "age1yj9yqk4nghkptn7ef6wu95r2dycmhu5xad3takaayusrs7sxyc5qdr9uy0"
+	ageId2     = "AGE-SECRET-KEY-18MH8QMMAUQKLQKC426K2MGUZQQPRD954C8K02DT6QQ4W3Y40C4NQTZAPFH"
+	recipient3 = "age1uqwr9dqhyj9rpmlp3594xsc9h6vv3w6vluptau5fq08azuhk8c7qzu6v3w"
+	ageId3     = "AGE-SECRET-KEY-1DT7MA24QWDDVAF730ULX4A83AWU98VN39RFJ0XCQ8V7GMFSKU3GQ302GWF"
 )
 
 func TestStorageWithAgeEncryption(t *testing.T) {
@@ -72,10 +86,14 @@ func TestStorageWithAgeEncryption(t *testing.T) {
 		t.Errorf("stat: %v", err)
 		return
 	}
-	if stat == (certmagic.KeyInfo{}) {
+	if stat.Size != int64(len(val)) {
 		t.Errorf("stat: size mismatch: %d!= %d", stat.Size, len(val))
 		return
 	}
+	if stat.Key != key || !stat.IsTerminal {
+		t.Errorf("stat: unexpected key info: %+v", stat)
+		return
+	}
 	data, err := s.Load(ctx, key)
 	if err != nil {
 		t.Errorf("load: %v", err)
@@ -95,6 +113,625 @@ func TestStorageWithAgeEncryption(t *testing.T) {
 	}
 }
 
+func TestStorageConcurrentStoreAndLoad(t *testing.T) {
+	for _, format := range []string{formatSOPS, formatEnvelope} {
+		t.Run(format, func(t *testing.T) {
+			testConcurrentStoreAndLoad(t, format)
+		})
+	}
+}
+
+// testConcurrentStoreAndLoad stores and loads concurrently in the format, then verifies every object decrypts.
+func testConcurrentStoreAndLoad(t *testing.T, format string) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"format": %q, "shamir_threshold": 2, "encryption": [{"provider": "local", "keys": [%s, %s, %s]}]}`,
+		format, ageKey(recipient, ageId), ageKey(recipient2, ageId2), ageKey(recipient3, ageId3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers, perWorker = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*perWorker)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				k := fmt.Sprintf("concurrent/%d/%d", w, i)
+				if err := s.Store(ctx, k, []byte(k)); err != nil {
+					errs <- err
+					continue
+				}
+				if _, err := s.Load(ctx, k); err != nil {
+					errs <- fmt.Errorf("%s: %v", k, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// every object decrypts with each pair of the keys alone
+	for _, pair := range [][2]string{{ageKey(recipient, ageId), ageKey(recipient2, ageId2)}, {ageKey(recipient2, ageId2), ageKey(recipient3, ageId3)}} {
+		l, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s, %s]}]}`, pair[0], pair[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for w := 0; w < workers; w++ {
+			for i := 0; i < perWorker; i++ {
+				k := fmt.Sprintf("concurrent/%d/%d", w, i)
+				if data, err := l.Load(ctx, k); err != nil || string(data) != k {
+					t.Errorf("%s: %s, %v", k, data, err)
+				}
+			}
+		}
+	}
+}
+
+func TestStorageWithMultipleProviders(t *testing.T) {
+	addr := startKeyServiceWithKeys(t, grpc.NewServer(), "tcp", "127.0.0.1:0", fmt.Sprintf(`[{"type":"age", "recipient": "%s", "identities": ["%s"]}]`, recipient2, ageId2))
+	dir := t.TempDir()
+	backend := json.RawMessage(fmt.Sprintf(`{"module": "file_system", "root": "%s"}`, filepath.ToSlash(dir)))
+	local := json.RawMessage(fmt.Sprintf(`{"provider":"local", "keys": [{"type":"age", "recipient": "%s", "identities": ["%s"]}]}`, recipient, ageId))
+	remote := json.RawMessage(fmt.Sprintf(`{"provider":"remote", "address": "%s", "insecure": true, "keys": [{"type":"age", "recipient": "%s"}]}`, addr, recipient2))
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s := Storage{
+		RawBackend: backend,
+		Encryption: []json.RawMessage{local, remote},
+	}
+	if err := s.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %s", err)
+	}
+	if err := s.Store(ctx, key, []byte(val)); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	fdata, err := os.ReadFile(filepath.Join(dir, key))
+	if err != nil {
+		t.Fatalf("error reading file: %s", err)
+	}
+	for _, r := range []string{recipient, recipient2} {
+		if !bytes.Contains(fdata, []byte(r)) {
+			t.Errorf("file should be encrypted to '%s'", r)
+		}
+	}
+	data, err := s.Load(ctx, key)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if string(data) != val {
+		t.Fatalf("load: data mismatch: %s != %s", data, val)
+	}
+
+	// the key groups of both providers are needed to reconstruct the data key
+	localOnly := Storage{
+		RawBackend: backend,
+		Encryption: []json.RawMessage{local},
+	}
+	if err := localOnly.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %s", err)
+	}
+	if _, err := localOnly.Load(ctx, key); err == nil {
+		t.Fatal("expected load to fail without the remote provider")
+	}
+}
+
+// ageKey returns the JSON config of an age key with the given identities.
+func ageKey(recipient string, identities ...string) string {
+	ids, _ := json.Marshal(identities)
+	return fmt.Sprintf(`{"type":"age", "recipient": %q, "identities": %s}`, recipient, ids)
+}
+
+// provisionStorage provisions an `encrypted` storage over the directory with the given JSON config fields.
+func provisionStorage(ctx caddy.Context, dir, config string) (*Storage, error) {
+	s := new(Storage)
+	if err := json.Unmarshal([]byte(config), s); err != nil {
+		return nil, err
+	}
+	s.RawBackend = json.RawMessage(fmt.Sprintf(`{"module": "file_system", "root": "%s"}`, filepath.ToSlash(dir)))
+	return s, s.Provision(ctx)
+}
+
+// storeAndLoad provisions an `encrypted` storage over the directory with the given JSON config fields,
+// then stores the test value with it, and returns the error of storing, loading, or the loaded data mismatch.
+func storeAndLoad(t *testing.T, dir, store, load string) error {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s, err := provisionStorage(ctx, dir, store)
+	if err != nil {
+		return fmt.Errorf("provision: %v", err)
+	}
+	if err := s.Store(ctx, key, []byte(val)); err != nil {
+		return fmt.Errorf("store: %v", err)
+	}
+	l, err := provisionStorage(ctx, dir, load)
+	if err != nil {
+		return fmt.Errorf("provision: %v", err)
+	}
+	data, err := l.Load(ctx, key)
+	if err != nil {
+		return fmt.Errorf("load: %v", err)
+	}
+	if string(data) != val {
+		return fmt.Errorf("load: data mismatch: %s != %s", data, val)
+	}
+	return nil
+}
+
+func TestStorageKeyGroupsAndShamirThreshold(t *testing.T) {
+	testcases := []struct {
+		name  string
+		store string
+		load  string
+		fails bool
+	}{
+		{
+			name:  "any key of the key group",
+			store: fmt.Sprintf(`{"encryption": [{"provider": "local", "key_groups": [[%s, %s]]}]}`, ageKey(recipient), ageKey(recipient2)),
+			load:  fmt.Sprintf(`{"encryption": [{"provider": "local", "key_groups": [[%s, %s]]}]}`, ageKey(recipient), ageKey(recipient2, ageId2)),
+		},
+		{
+			name:  "every key group by default",
+			store: fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s, %s]}]}`, ageKey(recipient), ageKey(recipient2)),
+			load:  fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s, %s]}]}`, ageKey(recipient), ageKey(recipient2, ageId2)),
+			fails: true,
+		},
+		{
+			name:  "2 of 3 key groups",
+			store: fmt.Sprintf(`{"shamir_threshold": 2, "encryption": [{"provider": "local", "keys": [%s, %s, %s]}]}`, ageKey(recipient), ageKey(recipient2), ageKey(recipient3)),
+			load:  fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s, %s, %s]}]}`, ageKey(recipient, ageId), ageKey(recipient2), ageKey(recipient3, ageId3)),
+		},
+		{
+			name:  "1 of 3 key groups below threshold",
+			store: fmt.Sprintf(`{"shamir_threshold": 2, "encryption": [{"provider": "local", "keys": [%s, %s, %s]}]}`, ageKey(recipient), ageKey(recipient2), ageKey(recipient3)),
+			load:  fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s, %s, %s]}]}`, ageKey(recipient), ageKey(recipient2), ageKey(recipient3, ageId3)),
+			fails: true,
+		},
+		{
+			name:  "threshold across key groups and keys",
+			store: fmt.Sprintf(`{"shamir_threshold": 2, "encryption": [{"provider": "local", "keys": [%s], "key_groups": [[%s, %s]]}]}`, ageKey(recipient), ageKey(recipient2), ageKey(recipient3)),
+			load:  fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s], "key_groups": [[%s, %s]]}]}`, ageKey(recipient, ageId), ageKey(recipient2), ageKey(recipient3, ageId3)),
+		},
+		{
+			name:  "threshold of 1",
+			store: fmt.Sprintf(`{"shamir_threshold": 1, "encryption": [{"provider": "local", "keys": [%s, %s]}]}`, ageKey(recipient, ageId), ageKey(recipient2, ageId2)),
+			fails: true,
+		},
+		{
+			name:  "threshold above the number of key groups",
+			store: fmt.Sprintf(`{"shamir_threshold": 3, "encryption": [{"provider": "local", "keys": [%s, %s]}]}`, ageKey(recipient, ageId), ageKey(recipient2, ageId2)),
+			fails: true,
+		},
+		{
+			name:  "negative threshold",
+			store: fmt.Sprintf(`{"shamir_threshold": -1, "encryption": [{"provider": "local", "keys": [%s, %s]}]}`, ageKey(recipient, ageId), ageKey(recipient2, ageId2)),
+			fails: true,
+		},
+		{
+			name:  "threshold of a single key group",
+			store: fmt.Sprintf(`{"shamir_threshold": 2, "encryption": [{"provider": "local", "key_groups": [[%s, %s]]}]}`, ageKey(recipient, ageId), ageKey(recipient2, ageId2)),
+			fails: true,
+		},
+		{
+			name:  "empty key group",
+			store: fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s], "key_groups": [[]]}]}`, ageKey(recipient, ageId)),
+			fails: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := storeAndLoad(t, t.TempDir(), tc.store, tc.load)
+			if tc.fails && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tc.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStorageWithLegacyKeys(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	retired, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s], "legacy_keys": [%s]}]}`, ageKey(recipient2, ageId2), ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := retired.Store(ctx, key, []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := rotated.Load(ctx, key)
+	if err != nil {
+		t.Fatalf("loading data of the legacy key: %v", err)
+	}
+	if string(data) != val {
+		t.Errorf("data mismatch: %s != %s", data, val)
+	}
+
+	if err := rotated.Store(ctx, key, []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := rotated.backend.Load(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte(recipient)) {
+		t.Error("the data key is encrypted with the legacy key")
+	}
+	if !bytes.Contains(raw, []byte(recipient2)) {
+		t.Error("the data key is not encrypted with the active key")
+	}
+	if _, err := retired.Load(ctx, key); err == nil {
+		t.Error("expected the retired key to not decrypt new data")
+	}
+}
+
+func TestStorageReencryptOnLoad(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	retired, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"reencrypt_on_load": true, "encryption": [{"provider": "local", "keys": [%s], "legacy_keys": [%s]}]}`, ageKey(recipient2, ageId2), ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := retired.Store(ctx, key, []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	outdated, err := rotated.backend.Load(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		data, err := rotated.Load(ctx, key)
+		if err != nil {
+			t.Fatalf("load %d: %v", i, err)
+		}
+		if string(data) != val {
+			t.Errorf("load %d: data mismatch: %s != %s", i, data, val)
+		}
+	}
+	rotated.rewrites.wait()
+	raw, err := rotated.backend.Load(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(raw, outdated) || bytes.Contains(raw, []byte(recipient)) {
+		t.Error("the data is not re-encrypted with the current keys")
+	}
+	if _, err := retired.Load(ctx, key); err == nil {
+		t.Error("expected the retired key to not decrypt the re-encrypted data")
+	}
+	if exists := rotated.backend.Exists(ctx, "locks/"+key+".lock"); exists {
+		t.Error("the lock is not released")
+	}
+}
+
+func TestStorageMigratePlaintext(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	keys := fmt.Sprintf(`"encryption": [{"provider": "local", "keys": [%s]}]`, ageKey(recipient, ageId))
+	s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"migrate_plaintext": {"path_prefixes": ["certificates/"]}, %s}`, keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := provisionStorage(ctx, dir, fmt.Sprintf(`{%s}`, keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := map[string]string{
+		"certificates/example.com/example.com.crt":  "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+		"certificates/example.com/example.com.json": `{"sans": ["example.com"]}`,
+		"acme/account.json":                         `{"status": "valid"}`,
+	}
+	for k, v := range plaintext {
+		if err := s.backend.Store(ctx, k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encrypted.Store(ctx, "certificates/corrupted", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	corrupted, err := s.backend.Load(ctx, "certificates/corrupted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted = corrupted[:len(corrupted)/2]
+	if err := s.backend.Store(ctx, "certificates/corrupted", corrupted); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"certificates/example.com/example.com.crt", "certificates/example.com/example.com.json"} {
+		if _, err := encrypted.Load(ctx, k); err == nil {
+			t.Errorf("%s: expected loading plaintext data to fail without migration", k)
+		}
+		for i := 0; i < 2; i++ {
+			data, err := s.Load(ctx, k)
+			if err != nil {
+				t.Fatalf("%s: load %d: %v", k, i, err)
+			}
+			if string(data) != plaintext[k] {
+				t.Errorf("%s: load %d: data mismatch: %s != %s", k, i, data, plaintext[k])
+			}
+		}
+		s.rewrites.wait()
+		raw, err := s.backend.Load(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte(plaintext[k])) {
+			t.Errorf("%s: the plaintext data is not stored encrypted", k)
+		}
+		if data, err := encrypted.Load(ctx, k); err != nil || string(data) != plaintext[k] {
+			t.Errorf("%s: loading migrated data: %s, %v", k, data, err)
+		}
+	}
+
+	if _, err := s.Load(ctx, "acme/account.json"); err == nil {
+		t.Error("expected plaintext data outside of the path prefixes to fail")
+	}
+	if _, err := s.Load(ctx, "certificates/corrupted"); err == nil {
+		t.Error("expected corrupted encrypted data to fail")
+	}
+	raw, err := s.backend.Load(ctx, "certificates/corrupted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, corrupted) {
+		t.Error("corrupted encrypted data is rewritten")
+	}
+}
+
+func TestStorageStat(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, key, []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := s.backend.Load(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := s.store.LoadEncryptedFile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the size is read without decrypting the data
+	locked, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, storage := range []*Storage{s, locked} {
+		stat, err := storage.Stat(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size != int64(len(val)) {
+			t.Errorf("size mismatch: %d != %d", stat.Size, len(val))
+		}
+		if !stat.Modified.Equal(tree.Metadata.LastModified) {
+			t.Errorf("modified mismatch: %s != %s", stat.Modified, tree.Metadata.LastModified)
+		}
+	}
+
+	// the size is part of the MAC
+	tampered := bytes.Replace(raw, []byte(fmt.Sprintf(`"%s": %d`, sizeKey, len(val))), []byte(fmt.Sprintf(`"%s": 1`, sizeKey)), 1)
+	if bytes.Equal(tampered, raw) {
+		t.Fatalf("size not found in the encrypted file: %s", raw)
+	}
+	if err := s.backend.Store(ctx, "tampered", tampered); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(ctx, "tampered"); err == nil {
+		t.Error("expected tampering with the size to fail the MAC")
+	}
+
+	// data stored without the size is not decrypted, and reported with the size of the stored object
+	legacy := unboundFile(t, s, val)
+	if err := s.backend.Store(ctx, "legacy", legacy); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := locked.Stat(ctx, "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != int64(len(legacy)) {
+		t.Errorf("legacy: size mismatch: %d != %d", stat.Size, len(legacy))
+	}
+
+	// the keys of the deny policies are not revealed
+	denied, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}], "policies": [{"paths": [%q], "action": "deny"}]}`, ageKey(recipient, ageId), key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := denied.Stat(ctx, key); !errors.Is(err, ErrDenied) {
+		t.Errorf("expected the stat of a denied key to fail: %v", err)
+	}
+
+	if err := s.backend.Store(ctx, "plaintext", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	stat, err = s.Stat(ctx, "plaintext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != int64(len(val)) {
+		t.Errorf("plaintext: size mismatch: %d != %d", stat.Size, len(val))
+	}
+}
+
+// unboundFile returns the data encrypted without the size and the storage key, as stored by the earlier versions.
+func unboundFile(t *testing.T, s *Storage, data string) []byte {
+	t.Helper()
+	branches, err := s.store.LoadPlainFile([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := sops.Tree{Branches: branches, Metadata: sops.Metadata{KeyGroups: s.keyGroups, LastModified: time.Now().UTC()}}
+	dataKey, errs := tree.GenerateDataKeyWithKeyServices(s.keyServiceClients)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if err := common.EncryptTree(common.EncryptTreeOpts{Tree: &tree, Cipher: aes.NewCipher(), DataKey: dataKey}); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := s.store.EmitEncryptedFile(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestStorageKeyBinding(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	config := fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId))
+	s, err := provisionStorage(ctx, dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, "certificates/example.com/example.com.key", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, "certificates/example.org/example.org.key", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data copied over another key fails to load
+	raw, err := s.backend.Load(ctx, "certificates/example.com/example.com.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.backend.Store(ctx, "certificates/example.org/example.org.key", raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(ctx, "certificates/example.org/example.org.key"); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected the swapped data to fail: %v", err)
+	}
+
+	// the data stored by the earlier versions loads unless bound data is required, and is bound once rewritten
+	if err := s.backend.Store(ctx, key, unboundFile(t, s, val)); err != nil {
+		t.Fatal(err)
+	}
+	strict, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"require_bound_data": true, "encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strict.Load(ctx, key); !errors.Is(err, ErrKeyMismatch) || !strings.Contains(err.Error(), "require_bound_data") {
+		t.Errorf("expected the unbound data to fail when bound data is required: %v", err)
+	}
+	if _, err := s.Load(ctx, "certificates/example.org/example.org.key"); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected the swapped data to fail when unbound data is loaded: %v", err)
+	}
+	data, err := s.Load(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != val {
+		t.Errorf("data mismatch: %s != %s", data, val)
+	}
+	s.rewrites.wait()
+	data, err = strict.Load(ctx, key)
+	if err != nil {
+		t.Fatalf("expected the data to be bound on load: %v", err)
+	}
+	if string(data) != val {
+		t.Errorf("data mismatch: %s != %s", data, val)
+	}
+}
+
+func TestKeyGroupsEqual(t *testing.T) {
+	mk := func(r string) keys.MasterKey { return &age.MasterKey{Recipient: r} }
+	testcases := []struct {
+		name  string
+		a, b  []sops.KeyGroup
+		equal bool
+	}{
+		{
+			name:  "same",
+			a:     []sops.KeyGroup{{mk(recipient)}, {mk(recipient2)}},
+			b:     []sops.KeyGroup{{mk(recipient)}, {mk(recipient2)}},
+			equal: true,
+		},
+		{
+			name:  "reordered",
+			a:     []sops.KeyGroup{{mk(recipient), mk(recipient2)}},
+			b:     []sops.KeyGroup{{mk(recipient2), mk(recipient)}},
+			equal: true,
+		},
+		{
+			name: "different key",
+			a:    []sops.KeyGroup{{mk(recipient)}},
+			b:    []sops.KeyGroup{{mk(recipient2)}},
+		},
+		{
+			name: "regrouped",
+			a:    []sops.KeyGroup{{mk(recipient)}, {mk(recipient2)}},
+			b:    []sops.KeyGroup{{mk(recipient), mk(recipient2)}},
+		},
+		{
+			name: "duplicate group",
+			a:    []sops.KeyGroup{{mk(recipient)}, {mk(recipient)}},
+			b:    []sops.KeyGroup{{mk(recipient)}, {mk(recipient2)}},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := keyGroupsEqual(tc.a, tc.b); got != tc.equal {
+				t.Errorf("keyGroupsEqual() = %v, want %v", got, tc.equal)
+			}
+		})
+	}
+}
+
+func TestEncryptedWith(t *testing.T) {
+	mk := func(r string) keys.MasterKey { return &age.MasterKey{Recipient: r} }
+	groups := []sops.KeyGroup{{mk(recipient)}, {mk(recipient2)}, {mk(recipient3)}}
+	testcases := []struct {
+		name      string
+		md        sops.Metadata
+		threshold int
+		equal     bool
+	}{
+		{name: "same threshold", md: sops.Metadata{KeyGroups: groups, ShamirThreshold: 2}, threshold: 2, equal: true},
+		{name: "all the key groups by default", md: sops.Metadata{KeyGroups: groups, ShamirThreshold: 3}, equal: true},
+		{name: "changed threshold", md: sops.Metadata{KeyGroups: groups, ShamirThreshold: 3}, threshold: 2},
+		{name: "changed key groups", md: sops.Metadata{KeyGroups: groups[:2], ShamirThreshold: 2}, threshold: 2},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := encryptedWith(tc.md, groups, tc.threshold); got != tc.equal {
+				t.Errorf("encryptedWith() = %v, want %v", got, tc.equal)
+			}
+		})
+	}
+}
+
 func TestCaddyfileAdaptToJSON(t *testing.T) {
 	testcases := []struct {
 		name   string
@@ -140,6 +777,833 @@ func TestCaddyfileAdaptToJSON(t *testing.T) {
 		],
 		"module": "encrypted"
 	}
+}`,
+		},
+		{
+			name: "remote provider",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider remote {
+			address keyservice.internal:5000
+			tls {
+				ca file /etc/caddy/keyservice-ca.pem
+				client_certificate /etc/caddy/edge.pem /etc/caddy/edge-key.pem
+				server_name keyservice.internal
+			}
+			key age {
+				recipient %s
+			}
+		}
+	}
+}
+`, recipient),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"address": "keyservice.internal:5000",
+				"keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "remote",
+				"tls": {
+					"ca": {
+						"pem_files": [
+							"/etc/caddy/keyservice-ca.pem"
+						],
+						"provider": "file"
+					},
+					"client_certificate_file": "/etc/caddy/edge.pem",
+					"client_certificate_key_file": "/etc/caddy/edge-key.pem",
+					"server_name": "keyservice.internal"
+				}
+			}
+		],
+		"module": "encrypted"
+	}
+}`,
+		},
+		{
+			name: "key service app",
+			input: fmt.Sprintf(`{
+	sops_keyservice {
+		listen unix//run/sops-keyservice.sock|0660 :5000
+		tls {
+			certificate /etc/caddy/keyservice.pem /etc/caddy/keyservice-key.pem
+			client_ca file /etc/caddy/edge-ca.pem
+		}
+		provider local {
+			key age {
+				recipient %s
+				identity %s
+			}
+		}
+	}
+}
+`, recipient, ageId),
+			output: `{
+	"apps": {
+		"sops_keyservice": {
+			"listen": [
+				"unix//run/sops-keyservice.sock|0660",
+				":5000"
+			],
+			"provider": {
+				"keys": [
+					{
+						"identities": [
+							"AGE-SECRET-KEY-16E6P6H93CXNPZQRJVNA5NMK4X06ZHCDU4ED9U89E3PZMASSMC46SX99PEW"
+						],
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			},
+			"tls": {
+				"certificate_file": "/etc/caddy/keyservice.pem",
+				"certificate_key_file": "/etc/caddy/keyservice-key.pem",
+				"client_ca": {
+					"pem_files": [
+						"/etc/caddy/edge-ca.pem"
+					],
+					"provider": "file"
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "key groups",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		shamir_threshold 2
+		provider local {
+			key age {
+				recipient %s
+			}
+			key_group {
+				key age {
+					recipient %s
+				}
+				key age {
+					recipient %s
+				}
+			}
+		}
+	}
+}
+`, recipient, recipient2, recipient3),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"key_groups": [
+					[
+						{
+							"recipient": "age1yj9yqk4nghkptn7ef6wu95r2dycmhu5xad3takaayusrs7sxyc5qdr9uy0",
+							"type": "age"
+						},
+						{
+							"recipient": "age1uqwr9dqhyj9rpmlp3594xsc9h6vv3w6vluptau5fq08azuhk8c7qzu6v3w",
+							"type": "age"
+						}
+					]
+				],
+				"keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted",
+		"shamir_threshold": 2
+	}
+}`,
+		},
+		{
+			name: "pgp key",
+			input: `{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider local {
+			key pgp {
+				fingerprint 85D77543B3D624B63CEA9E6DBC17301B491B3F21
+				private_key_file /etc/caddy/pgp.asc
+				passphrase {env.PGP_PASSPHRASE}
+			}
+		}
+	}
+}
+`,
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"fingerprint": "85D77543B3D624B63CEA9E6DBC17301B491B3F21",
+						"passphrase": "{env.PGP_PASSPHRASE}",
+						"private_key_file": "/etc/caddy/pgp.asc",
+						"type": "pgp"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted"
+	}
+}`,
+		},
+		{
+			name: "aws kms key",
+			input: `{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider local {
+			key aws_kms {
+				arn arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab
+				role arn:aws:iam::111122223333:role/caddy
+				encryption_context app caddy
+				region us-east-2
+				credentials {env.AWS_KEY_ID} {env.AWS_SECRET}
+				endpoint http://localhost:4566
+			}
+		}
+	}
+}
+`,
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"access_key_id": "{env.AWS_KEY_ID}",
+						"arn": "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+						"encryption_context": {
+							"app": "caddy"
+						},
+						"endpoint": "http://localhost:4566",
+						"region": "us-east-2",
+						"role": "arn:aws:iam::111122223333:role/caddy",
+						"secret_access_key": "{env.AWS_SECRET}",
+						"type": "aws_kms"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted"
+	}
+}`,
+		},
+		{
+			name: "azure key vault key",
+			input: `{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider local {
+			key azure_kv {
+				vault_url https://caddy.vault.azure.net
+				key_name storage
+				version 0123456789abcdef0123456789abcdef
+				client_id 00000000-0000-0000-0000-000000000002
+				managed_identity
+			}
+		}
+	}
+}
+`,
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"client_id": "00000000-0000-0000-0000-000000000002",
+						"key_name": "storage",
+						"managed_identity": true,
+						"type": "azure_kv",
+						"vault_url": "https://caddy.vault.azure.net",
+						"version": "0123456789abcdef0123456789abcdef"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted"
+	}
+}`,
+		},
+		{
+			name: "hashicorp vault key",
+			input: `{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider local {
+			key hc_vault {
+				address https://vault.internal:8200
+				engine_path sops
+				key_name caddy
+				approle {
+					role_id {env.VAULT_ROLE_ID}
+					secret_id {env.VAULT_SECRET_ID}
+				}
+				namespace team-a
+				ca_cert /etc/caddy/vault-ca.pem
+			}
+		}
+	}
+}
+`,
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"address": "https://vault.internal:8200",
+						"approle": {
+							"role_id": "{env.VAULT_ROLE_ID}",
+							"secret_id": "{env.VAULT_SECRET_ID}"
+						},
+						"ca_cert": "/etc/caddy/vault-ca.pem",
+						"engine_path": "sops",
+						"key_name": "caddy",
+						"namespace": "team-a",
+						"type": "hc_vault"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted"
+	}
+}`,
+		},
+		{
+			name: "age identity files",
+			input: `{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider local {
+			key age {
+				recipient "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN"
+				identity_file /etc/caddy/deploy_key
+				identity_file /etc/caddy/age-keys.txt
+				ssh_passphrase {env.SSH_PASSPHRASE}
+			}
+		}
+	}
+}
+`,
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"identity_files": [
+							"/etc/caddy/deploy_key",
+							"/etc/caddy/age-keys.txt"
+						],
+						"recipient": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN",
+						"ssh_passphrase": "{env.SSH_PASSPHRASE}",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted"
+	}
+}`,
+		},
+		{
+			name: "age recipients",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider local {
+			key age {
+				recipients %s %s
+				recipients_file /etc/caddy/recipients.txt
+			}
+		}
+	}
+}
+`, recipient, recipient2),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"recipients": [
+							"age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+							"age1yj9yqk4nghkptn7ef6wu95r2dycmhu5xad3takaayusrs7sxyc5qdr9uy0"
+						],
+						"recipients_files": [
+							"/etc/caddy/recipients.txt"
+						],
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted"
+	}
+}`,
+		},
+		{
+			name: "legacy keys",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider local {
+			key age {
+				recipient %s
+			}
+			legacy_key age {
+				recipient %s
+			}
+		}
+	}
+}
+`, recipient2, recipient),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"recipient": "age1yj9yqk4nghkptn7ef6wu95r2dycmhu5xad3takaayusrs7sxyc5qdr9uy0",
+						"type": "age"
+					}
+				],
+				"legacy_keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted"
+	}
+}`,
+		},
+		{
+			name: "reencrypt on load",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		reencrypt_on_load
+		provider local {
+			key age {
+				recipient %s
+			}
+		}
+	}
+}
+`, recipient),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted",
+		"reencrypt_on_load": true
+	}
+}`,
+		},
+		{
+			name: "migrate plaintext",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		migrate_plaintext certificates/ acme/
+		provider local {
+			key age {
+				recipient %s
+			}
+		}
+	}
+}
+`, recipient),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"migrate_plaintext": {
+			"path_prefixes": [
+				"certificates/",
+				"acme/"
+			]
+		},
+		"module": "encrypted"
+	}
+}`,
+		},
+		{
+			name: "obfuscate names",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		obfuscate_names {env.NAMES_SECRET}
+		provider local {
+			key age {
+				recipient %s
+			}
+		}
+	}
+}
+`, recipient),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted",
+		"obfuscate_names": {
+			"secret": "{env.NAMES_SECRET}"
+		}
+	}
+}`,
+		},
+		{
+			name: "require bound data",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		require_bound_data
+		provider local {
+			key age {
+				recipient %s
+			}
+		}
+	}
+}
+`, recipient),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted",
+		"require_bound_data": true
+	}
+}`,
+		},
+		{
+			name: "policies",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider local {
+			key age {
+				recipient %s
+			}
+		}
+		policy plaintext *.crt ocsp/*
+		policy deny {
+			path_regexp ^backups/
+		}
+		policy encrypt *.key {
+			provider local {
+				key age {
+					recipient %s
+				}
+			}
+		}
+	}
+}
+`, recipient, recipient2),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted",
+		"policies": [
+			{
+				"action": "plaintext",
+				"paths": [
+					"*.crt",
+					"ocsp/*"
+				]
+			},
+			{
+				"action": "deny",
+				"path_regexp": "^backups/"
+			},
+			{
+				"action": "encrypt",
+				"encryption": [
+					{
+						"keys": [
+							{
+								"recipient": "` + recipient2 + `",
+								"type": "age"
+							}
+						],
+						"provider": "local"
+					}
+				],
+				"paths": [
+					"*.key"
+				]
+			}
+		]
+	}
+}`,
+		},
+		{
+			name: "policy tenants",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		provider local {
+			key age {
+				recipient %s
+			}
+		}
+		policy encrypt certificates/*/*/* {
+			tenant {storage.key.2} {
+				example.com {
+					provider local {
+						key age {
+							recipient %s
+						}
+					}
+				}
+			}
+		}
+	}
+}
+`, recipient, recipient2),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"encryption": [
+			{
+				"keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"module": "encrypted",
+		"policies": [
+			{
+				"action": "encrypt",
+				"paths": [
+					"certificates/*/*/*"
+				],
+				"tenant": "{storage.key.2}",
+				"tenants": {
+					"example.com": {
+						"encryption": [
+							{
+								"keys": [
+									{
+										"recipient": "` + recipient2 + `",
+										"type": "age"
+									}
+								],
+								"provider": "local"
+							}
+						]
+					}
+				}
+			}
+		]
+	}
+}`,
+		},
+		{
+			name: "envelope format",
+			input: fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root /var/caddy/storage
+		}
+		format envelope
+		cipher xchacha20-poly1305
+		provider local {
+			key age {
+				recipient %s
+			}
+		}
+	}
+}
+`, recipient),
+			output: `{
+	"storage": {
+		"backend": {
+			"module": "file_system",
+			"root": "/var/caddy/storage"
+		},
+		"cipher": "xchacha20-poly1305",
+		"encryption": [
+			{
+				"keys": [
+					{
+						"recipient": "age1pjtsgtdh79nksq08ujpx8hrup0yrpn4sw3gxl4yyh0vuggjjp3ls7f42y2",
+						"type": "age"
+					}
+				],
+				"provider": "local"
+			}
+		],
+		"format": "envelope",
+		"module": "encrypted"
+	}
 }`,
 		},
 	}
@@ -0,0 +1,290 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// NameObfuscation configures the obfuscation of the key names in the backend, so the
+// names, e.g. of the served domains, are not revealed to whoever can read the backend.
+// Each segment of a key path is named by a keyed HMAC of the path up to it, and the
+// real names are kept in an index encrypted like the data, so the storage still lists
+// the real names.
+type NameObfuscation struct {
+	// The secret keying the HMAC of the names, at least 16 bytes long. The data
+	// stored under names obfuscated with a secret cannot be found without it.
+	Secret string `json:"secret,omitempty"`
+}
+
+// nameEncoding is the filesystem-safe, case-insensitive encoding of the obfuscated names.
+var nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// obfuscatedStorage is the backend of the `encrypted` storage with the key
+// names obfuscated, holding the encrypted index of the real names.
+type obfuscatedStorage struct {
+	certmagic.Storage
+
+	secret []byte
+
+	// the storage encrypting and decrypting the index
+	storage *Storage
+
+	// the backend key of the index
+	indexKey string
+
+	// the decrypted index along with the stored index it is decrypted from, so the index
+	// is only decrypted again once changed, e.g. by another instance sharing the backend
+	mu        sync.Mutex
+	cachedRaw []byte
+	cached    map[string]struct{}
+}
+
+func newObfuscatedStorage(s *Storage, backend certmagic.Storage, secret []byte) *obfuscatedStorage {
+	o := &obfuscatedStorage{
+		Storage: backend,
+		secret:  secret,
+		storage: s,
+	}
+	// NUL cannot be part of a key, so the index cannot collide with the data
+	o.indexKey = o.hmac("\x00index")
+	return o
+}
+
+func (o *obfuscatedStorage) hmac(name string) string {
+	mac := hmac.New(sha256.New, o.secret)
+	mac.Write([]byte(name))
+	return nameEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// name returns the obfuscated name of the key, where each path segment is
+// named by the HMAC of the path up to it.
+func (o *obfuscatedStorage) name(key string) string {
+	if key == "" {
+		return ""
+	}
+	segments := strings.Split(key, "/")
+	names := make([]string, len(segments))
+	for i := range segments {
+		names[i] = o.hmac(strings.Join(segments[:i+1], "/"))
+	}
+	return strings.Join(names, "/")
+}
+
+// Load implements certmagic.Storage.
+func (o *obfuscatedStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	return o.Storage.Load(ctx, o.name(key))
+}
+
+// Store implements certmagic.Storage. A new key is added to the index before the data is
+// stored, so the stored data is always listed, even if storing it is interrupted. The stored
+// index is read every time, as other instances sharing the backend may have deleted the key,
+// but it is only decrypted once changed, and only written when the key is new.
+func (o *obfuscatedStorage) Store(ctx context.Context, key string, value []byte) error {
+	keys, err := o.index(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[key]; !ok {
+		err := o.updateIndex(ctx, func(keys map[string]struct{}) bool {
+			if _, ok := keys[key]; ok {
+				return false
+			}
+			keys[key] = struct{}{}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return o.Storage.Store(ctx, o.name(key), value)
+}
+
+// Delete implements certmagic.Storage. The keys under the key are deleted as well.
+func (o *obfuscatedStorage) Delete(ctx context.Context, key string) error {
+	if err := o.Storage.Delete(ctx, o.name(key)); err != nil {
+		return err
+	}
+	return o.updateIndex(ctx, func(keys map[string]struct{}) bool {
+		changed := false
+		for k := range keys {
+			if k == key || strings.HasPrefix(k, key+"/") {
+				delete(keys, k)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// Exists implements certmagic.Storage.
+func (o *obfuscatedStorage) Exists(ctx context.Context, key string) bool {
+	return o.Storage.Exists(ctx, o.name(key))
+}
+
+// Stat implements certmagic.Storage.
+func (o *obfuscatedStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	info, err := o.Storage.Stat(ctx, o.name(key))
+	info.Key = key
+	return info, err
+}
+
+// List implements certmagic.Storage. The keys are listed from the index, along with their
+// parent paths, the same way the `file_system` storage lists the files and directories.
+// A key whose data failed to be stored is listed, but does not exist until stored again.
+func (o *obfuscatedStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	keys, err := o.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	prefix = strings.Trim(prefix, "/")
+	listed := make(map[string]struct{})
+	for k := range keys {
+		rel := k
+		if prefix != "" {
+			if !strings.HasPrefix(k, prefix+"/") {
+				continue
+			}
+			rel = k[len(prefix)+1:]
+		}
+		segments := strings.Split(rel, "/")
+		depth := 1
+		if recursive {
+			depth = len(segments)
+		}
+		for i := 1; i <= depth; i++ {
+			listed[path.Join(prefix, strings.Join(segments[:i], "/"))] = struct{}{}
+		}
+	}
+	if len(listed) == 0 && prefix != "" {
+		return nil, fs.ErrNotExist
+	}
+	list := make([]string, 0, len(listed))
+	for k := range listed {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// Lock implements certmagic.Storage.
+func (o *obfuscatedStorage) Lock(ctx context.Context, name string) error {
+	return o.Storage.Lock(ctx, o.name(name))
+}
+
+// Unlock implements certmagic.Storage.
+func (o *obfuscatedStorage) Unlock(ctx context.Context, name string) error {
+	return o.Storage.Unlock(ctx, o.name(name))
+}
+
+// loadIndex loads the real names of the stored keys from the encrypted index.
+func (o *obfuscatedStorage) loadIndex(ctx context.Context) (map[string]struct{}, error) {
+	keys, err := o.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return maps.Clone(keys), nil
+}
+
+// index returns the real names of the stored keys, decrypting the stored index only when it
+// is changed since last decrypted. The returned keys are shared, and must not be modified.
+func (o *obfuscatedStorage) index(ctx context.Context) (map[string]struct{}, error) {
+	bs, err := o.Storage.Load(ctx, o.indexKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]struct{}{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading name index: %w", err)
+	}
+	o.mu.Lock()
+	if o.cached != nil && bytes.Equal(bs, o.cachedRaw) {
+		keys := o.cached
+		o.mu.Unlock()
+		return keys, nil
+	}
+	o.mu.Unlock()
+	plaintext, err := o.storage.decrypt(o.indexKey, bs)
+	if err != nil {
+		return nil, fmt.Errorf("loading name index: %w", err)
+	}
+	var list []string
+	if err := json.Unmarshal(plaintext, &list); err != nil {
+		return nil, fmt.Errorf("loading name index: %w: %v", ErrMalformed, err)
+	}
+	keys := make(map[string]struct{}, len(list))
+	for _, k := range list {
+		keys[k] = struct{}{}
+	}
+	o.cacheIndex(bs, keys)
+	return keys, nil
+}
+
+// cacheIndex records the decrypted index along with the stored index it is decrypted from.
+func (o *obfuscatedStorage) cacheIndex(raw []byte, keys map[string]struct{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cachedRaw, o.cached = raw, keys
+}
+
+// updateIndex applies the change to the index while holding its lock, and stores
+// the index with the current key groups when the change reports it is changed.
+func (o *obfuscatedStorage) updateIndex(ctx context.Context, change func(keys map[string]struct{}) bool) error {
+	if err := o.Storage.Lock(ctx, o.indexKey); err != nil {
+		return fmt.Errorf("acquiring name index lock: %v", err)
+	}
+	defer func() {
+		if err := o.Storage.Unlock(ctx, o.indexKey); err != nil {
+			o.storage.logger.Error("failed to release name index lock", zap.Error(err))
+		}
+	}()
+	keys, err := o.loadIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if !change(keys) {
+		return nil
+	}
+	return o.storeIndex(ctx, keys)
+}
+
+func (o *obfuscatedStorage) storeIndex(ctx context.Context, keys map[string]struct{}) error {
+	list := make([]string, 0, len(keys))
+	for k := range keys {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	plaintext, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("storing name index: %v", err)
+	}
+	encryptedFile, err := o.storage.encrypt(o.indexKey, plaintext)
+	if err != nil {
+		return fmt.Errorf("storing name index: %w", err)
+	}
+	if err := o.Storage.Store(ctx, o.indexKey, encryptedFile); err != nil {
+		return fmt.Errorf("storing name index: %w", err)
+	}
+	o.cacheIndex(encryptedFile, keys)
+	return nil
+}
+
+// rotateIndex stores the index again with the current key groups.
+func (o *obfuscatedStorage) rotateIndex(ctx context.Context) error {
+	return o.updateIndex(ctx, func(map[string]struct{}) bool { return true })
+}
+
+var _ certmagic.Storage = (*obfuscatedStorage)(nil)
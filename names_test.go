@@ -0,0 +1,237 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestStorageWithObfuscatedNames(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	t.Setenv("TEST_NAMES_SECRET", "0123456789abcdef0123456789abcdef")
+	config := func(secret string) string {
+		return fmt.Sprintf(`{"obfuscate_names": {"secret": %q}, "encryption": [{"provider": "local", "keys": [%s]}]}`, secret, ageKey(recipient, ageId))
+	}
+	s, err := provisionStorage(ctx, dir, config("{env.TEST_NAMES_SECRET}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{
+		"acme/acme-v02.api.letsencrypt.org-directory/users/default/default.key",
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.key",
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.org/example.org.crt",
+	}
+	for _, k := range keys {
+		if err := s.Store(ctx, k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.WalkDir(dir, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{"example", "acme", "certificates", "issue_cert"} {
+			if strings.Contains(p, name) {
+				t.Errorf("the backend reveals the name %s: %s", name, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range keys {
+		data, err := s.Load(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != k {
+			t.Errorf("data mismatch: %s != %s", data, k)
+		}
+		stat, err := s.Stat(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Key != k || stat.Size != int64(len(k)) || !stat.IsTerminal {
+			t.Errorf("unexpected key info: %+v", stat)
+		}
+	}
+
+	list := func(prefix string, recursive bool) string {
+		t.Helper()
+		keys, err := s.List(ctx, prefix, recursive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+	if got, want := list("certificates/acme-v02.api.letsencrypt.org-directory", false),
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com,certificates/acme-v02.api.letsencrypt.org-directory/example.org"; got != want {
+		t.Errorf("list: got %s, want %s", got, want)
+	}
+	if got, want := list("certificates", true), strings.Join([]string{
+		"certificates/acme-v02.api.letsencrypt.org-directory",
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com",
+		keys[1], keys[2],
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.org",
+		keys[3],
+	}, ","); got != want {
+		t.Errorf("recursive list: got %s, want %s", got, want)
+	}
+	if got, want := list("", false), "acme,certificates"; got != want {
+		t.Errorf("root list: got %s, want %s", got, want)
+	}
+	if _, err := s.List(ctx, "missing", true); err == nil {
+		t.Error("expected listing a missing prefix to fail")
+	}
+	stat, err := s.Stat(ctx, "certificates/acme-v02.api.letsencrypt.org-directory/example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.IsTerminal {
+		t.Errorf("expected a directory: %+v", stat)
+	}
+
+	// the index is shared by the instances with the same secret
+	other, err := provisionStorage(ctx, dir, config("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Delete(ctx, "certificates/acme-v02.api.letsencrypt.org-directory/example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list("certificates/acme-v02.api.letsencrypt.org-directory", true), "certificates/acme-v02.api.letsencrypt.org-directory/example.org,"+keys[3]; got != want {
+		t.Errorf("list after delete: got %s, want %s", got, want)
+	}
+	if s.Exists(ctx, keys[1]) {
+		t.Error("expected the deleted key to not exist")
+	}
+	// a key deleted by the other instance is indexed again once stored again
+	if err := s.Store(ctx, keys[1], []byte(keys[1])); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Delete(ctx, keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, keys[1], []byte(keys[1])); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := other.List(ctx, "certificates", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(listed, keys[1]) {
+		t.Errorf("expected the key stored again to be listed: %v", listed)
+	}
+
+	// the index is only written when a new key is stored, and only decrypted once changed
+	o := s.backend.(*obfuscatedStorage)
+	index, err := o.Storage.Load(ctx, o.indexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, keys[1], []byte(keys[1])); err != nil {
+		t.Fatal(err)
+	}
+	after, err := o.Storage.Load(ctx, o.indexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(index, after) {
+		t.Error("expected the index to not be rewritten when storing a known key")
+	}
+	if !bytes.Equal(o.cachedRaw, after) {
+		t.Error("expected the decrypted index to be cached")
+	}
+
+	// the key is indexed before its data is stored, so failing to store the
+	// data leaves no data unlisted, and storing it again succeeds
+	blocked := filepath.Join(dir, filepath.FromSlash(s.backend.(*obfuscatedStorage).name("blocked")))
+	if err := os.MkdirAll(blocked, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, "blocked", []byte(val)); err == nil {
+		t.Fatal("expected storing over a directory to fail")
+	}
+	if got := list("", false); !strings.Contains(got, "blocked") {
+		t.Errorf("expected the key failed to store to be listed: %s", got)
+	}
+	if err := os.Remove(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, "blocked", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := other.Load(ctx, "blocked"); err != nil || string(data) != val {
+		t.Errorf("expected the key stored again to load: %s, %v", data, err)
+	}
+
+	wrong, err := provisionStorage(ctx, dir, config("fedcba9876543210fedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Load(ctx, keys[0]); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the data to not be found with another secret: %v", err)
+	}
+	if got, err := wrong.List(ctx, "", true); err != nil || len(got) != 0 {
+		t.Errorf("expected no keys listed with another secret: %v, %v", got, err)
+	}
+
+	if _, err := provisionStorage(ctx, dir, config("short")); err == nil {
+		t.Error("expected a short secret to fail")
+	}
+	if _, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"migrate_plaintext": {}, "obfuscate_names": {"secret": "0123456789abcdef"}, "encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId))); err == nil {
+		t.Error("expected plaintext migration with obfuscated names to fail")
+	}
+}
+
+func TestRotationWithObfuscatedNames(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	const secret = "0123456789abcdef0123456789abcdef"
+	retired, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"obfuscate_names": {"secret": %q}, "encryption": [{"provider": "local", "keys": [%s]}]}`, secret, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"obfuscate_names": {"secret": %q}, "encryption": [{"provider": "local", "keys": [%s], "legacy_keys": [%s]}]}`, secret, ageKey(recipient2, ageId2), ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := retired.Store(ctx, key, []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	summary, err := (&rotation{storage: rotated, concurrency: 1}).run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.rotated) != 1 || len(summary.failed) != 0 {
+		t.Fatalf("rotated %v, failed %v", summary.rotated, summary.failed)
+	}
+	// neither the data nor the index can be decrypted with the retired key
+	if _, err := retired.Load(ctx, key); err == nil {
+		t.Error("expected the data to be rotated")
+	}
+	if _, err := retired.List(ctx, "", true); err == nil {
+		t.Error("expected the name index to be rotated")
+	}
+}
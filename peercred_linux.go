@@ -0,0 +1,34 @@
+//go:build linux
+
+package encryptedstorage
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const peerCredSupported = true
+
+// peerUID returns the user ID of the process on the other end of the Unix domain socket.
+func peerUID(conn net.Conn) (int, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("expected a Unix domain socket connection, got %T", conn)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return int(cred.Uid), nil
+}
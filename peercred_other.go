@@ -0,0 +1,15 @@
+//go:build !linux
+
+package encryptedstorage
+
+import (
+	"errors"
+	"net"
+)
+
+const peerCredSupported = false
+
+// peerUID is only implemented on Linux.
+func peerUID(net.Conn) (int, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,196 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/getsops/sops/v3/pgp"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(PGP{})
+}
+
+// PGP is a key type using an OpenPGP key for the encryption/decryption. Unlike the `sops` CLI,
+// the key material is taken from the configuration rather than the GnuPG keyring of the host.
+// See more: [https://github.com/getsops/sops#encrypting-using-pgp](https://github.com/getsops/sops#encrypting-using-pgp)
+type PGP struct {
+	// The fingerprint of the key. It may be omitted if the configured
+	// key material holds a single key.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// The ASCII-armored public key. It is only needed for encryption,
+	// and not needed if the private key is configured.
+	PublicKey string `json:"public_key,omitempty"`
+
+	// The path of the file holding the ASCII-armored public key.
+	PublicKeyFile string `json:"public_key_file,omitempty"`
+
+	// The ASCII-armored private key, needed for decryption.
+	PrivateKey string `json:"private_key,omitempty"`
+
+	// The path of the file holding the ASCII-armored private key.
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+
+	// The passphrase protecting the private key, if any.
+	Passphrase string `json:"passphrase,omitempty"`
+
+	entity *openpgp.Entity
+	mk     *pgp.MasterKey
+}
+
+// Provision implements caddy.Provisioner.
+func (p *PGP) Provision(ctx caddy.Context) error {
+	r, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		r = caddy.NewReplacer()
+	}
+	armored, err := p.keyMaterial(r)
+	if err != nil {
+		return err
+	}
+	ring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return fmt.Errorf("reading PGP key: %v", err)
+	}
+
+	p.Fingerprint = normalizeFingerprint(r.ReplaceKnown(p.Fingerprint, ""))
+	switch {
+	case p.Fingerprint == "" && len(ring) == 1:
+		p.entity = ring[0]
+		p.Fingerprint = entityFingerprint(ring[0])
+	case p.Fingerprint == "":
+		return fmt.Errorf("the PGP key material holds %d keys, the fingerprint must be specified", len(ring))
+	default:
+		for _, e := range ring {
+			if entityFingerprint(e) == p.Fingerprint {
+				p.entity = e
+				break
+			}
+		}
+		if p.entity == nil {
+			return fmt.Errorf("PGP key with fingerprint '%s' not found in the key material", p.Fingerprint)
+		}
+	}
+
+	if p.entity.PrivateKey != nil && p.entity.PrivateKey.Encrypted {
+		passphrase := r.ReplaceKnown(p.Passphrase, "")
+		if passphrase == "" {
+			return fmt.Errorf("PGP private key '%s' is protected by a passphrase, but none is configured", p.Fingerprint)
+		}
+		if err := p.entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+			return fmt.Errorf("decrypting PGP private key '%s': %v", p.Fingerprint, err)
+		}
+	}
+	p.mk = pgp.NewMasterKeyFromFingerprint(p.Fingerprint)
+	return nil
+}
+
+// keyMaterial returns the armored key, preferring the private key.
+func (p *PGP) keyMaterial(r *caddy.Replacer) (string, error) {
+	if p.PrivateKey != "" && p.PrivateKeyFile != "" {
+		return "", errors.New("fields 'private_key' and 'private_key_file' are mutually exclusive")
+	}
+	if p.PublicKey != "" && p.PublicKeyFile != "" {
+		return "", errors.New("fields 'public_key' and 'public_key_file' are mutually exclusive")
+	}
+	switch {
+	case p.PrivateKey != "":
+		return r.ReplaceKnown(p.PrivateKey, ""), nil
+	case p.PrivateKeyFile != "":
+		bs, err := os.ReadFile(r.ReplaceKnown(p.PrivateKeyFile, ""))
+		return string(bs), err
+	case p.PublicKey != "":
+		return r.ReplaceKnown(p.PublicKey, ""), nil
+	case p.PublicKeyFile != "":
+		bs, err := os.ReadFile(r.ReplaceKnown(p.PublicKeyFile, ""))
+		return string(bs), err
+	}
+	return "", errors.New("either the public key or the private key must be specified")
+}
+
+// encrypt implements keyCrypter. It encrypts the data key to the configured key, ASCII-armored as done by SOPS.
+func (p *PGP) encrypt(dataKey []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	armorWriter, err := armor.Encode(buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	plainWriter, err := openpgp.Encrypt(armorWriter, []*openpgp.Entity{p.entity}, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := plainWriter.Write(dataKey); err != nil {
+		return nil, err
+	}
+	if err := plainWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := armorWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decrypt implements keyCrypter. It decrypts the ASCII-armored data key with the configured private key.
+func (p *PGP) decrypt(ciphertext []byte) ([]byte, error) {
+	if p.entity.PrivateKey == nil {
+		return nil, fmt.Errorf("no private key is configured for PGP key '%s'", p.Fingerprint)
+	}
+	block, err := armor.Decode(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, fmt.Errorf("armor decoding failed: %v", err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{p.entity}, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reading PGP message failed: %v", err)
+	}
+	return io.ReadAll(md.UnverifiedBody)
+}
+
+// matches implements keyCrypter.
+func (p *PGP) matches(key *keyservice.Key) bool {
+	k, ok := key.GetKeyType().(*keyservice.Key_PgpKey)
+	return ok && normalizeFingerprint(k.PgpKey.Fingerprint) == p.Fingerprint
+}
+
+// CaddyModule implements caddy.Module.
+func (PGP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.storage.encrypted.key.pgp",
+		New: func() caddy.Module {
+			return new(PGP)
+		},
+	}
+}
+
+// ToMasterkey implements MasterkeyConverter.
+func (p *PGP) ToMasterkey() keys.MasterKey {
+	return p.mk
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+}
+
+func entityFingerprint(e *openpgp.Entity) string {
+	return strings.ToUpper(hex.EncodeToString(e.PrimaryKey.Fingerprint))
+}
+
+var (
+	_ caddy.Module       = (*PGP)(nil)
+	_ caddy.Provisioner  = (*PGP)(nil)
+	_ MasterkeyConverter = (*PGP)(nil)
+	_ keyCrypter         = (*PGP)(nil)
+)
@@ -0,0 +1,140 @@
+package encryptedstorage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// testPGPKey holds the armored material of a generated PGP key.
+type testPGPKey struct {
+	fingerprint string
+	public      string
+	private     string
+}
+
+func newTestPGPKey(t *testing.T, passphrase string) testPGPKey {
+	t.Helper()
+	e, err := openpgp.NewEntity("caddy", "test", "caddy@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := new(strings.Builder)
+	w, err := armor.Encode(public, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if passphrase != "" {
+		if err := e.EncryptPrivateKeys([]byte(passphrase), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	private := new(strings.Builder)
+	w, err = armor.Encode(private, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return testPGPKey{
+		fingerprint: entityFingerprint(e),
+		public:      public.String(),
+		private:     private.String(),
+	}
+}
+
+func TestStorageWithPGPEncryption(t *testing.T) {
+	plain := newTestPGPKey(t, "")
+	protected := newTestPGPKey(t, "s3cret")
+	privateFile := filepath.Join(t.TempDir(), "private.asc")
+	if err := os.WriteFile(privateFile, []byte(plain.private), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_PGP_PASSPHRASE", "s3cret")
+
+	local := func(keys ...string) string {
+		return fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, strings.Join(keys, ","))
+	}
+	pgpKey := func(fields string) string {
+		return fmt.Sprintf(`{"type": "pgp", %s}`, fields)
+	}
+	testcases := []struct {
+		name  string
+		store string
+		load  string
+		fails bool
+	}{
+		{
+			name:  "inline private key",
+			store: local(pgpKey(fmt.Sprintf(`"private_key": %q`, plain.private))),
+			load:  local(pgpKey(fmt.Sprintf(`"private_key": %q`, plain.private))),
+		},
+		{
+			name:  "public key for encryption, private key file for decryption",
+			store: local(pgpKey(fmt.Sprintf(`"fingerprint": %q, "public_key": %q`, plain.fingerprint, plain.public))),
+			load:  local(pgpKey(fmt.Sprintf(`"fingerprint": %q, "private_key_file": %q`, plain.fingerprint, privateFile))),
+		},
+		{
+			name:  "passphrase from placeholder",
+			store: local(pgpKey(fmt.Sprintf(`"public_key": %q`, protected.public))),
+			load:  local(pgpKey(fmt.Sprintf(`"private_key": %q, "passphrase": "{env.TEST_PGP_PASSPHRASE}"`, protected.private))),
+		},
+		{
+			name:  "PGP and age keys",
+			store: local(pgpKey(fmt.Sprintf(`"public_key": %q`, plain.public)), ageKey(recipient)),
+			load:  local(pgpKey(fmt.Sprintf(`"private_key": %q`, plain.private)), ageKey(recipient, ageId)),
+		},
+		{
+			name:  "wrong passphrase",
+			store: local(pgpKey(fmt.Sprintf(`"public_key": %q`, protected.public))),
+			load:  local(pgpKey(fmt.Sprintf(`"private_key": %q, "passphrase": "wrong"`, protected.private))),
+			fails: true,
+		},
+		{
+			name:  "missing passphrase",
+			store: local(pgpKey(fmt.Sprintf(`"public_key": %q`, protected.public))),
+			load:  local(pgpKey(fmt.Sprintf(`"private_key": %q`, protected.private))),
+			fails: true,
+		},
+		{
+			name:  "public key only",
+			store: local(pgpKey(fmt.Sprintf(`"public_key": %q`, plain.public))),
+			load:  local(pgpKey(fmt.Sprintf(`"public_key": %q`, plain.public))),
+			fails: true,
+		},
+		{
+			name:  "unknown fingerprint",
+			store: local(pgpKey(fmt.Sprintf(`"fingerprint": %q, "public_key": %q`, protected.fingerprint, plain.public))),
+			fails: true,
+		},
+		{
+			name:  "no key material",
+			store: local(pgpKey(fmt.Sprintf(`"fingerprint": %q`, plain.fingerprint))),
+			fails: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := storeAndLoad(t, t.TempDir(), tc.store, tc.load)
+			if tc.fails && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tc.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package encryptedstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/getsops/sops/v3"
+)
+
+// The actions of the policies.
+const (
+	actionEncrypt   = "encrypt"
+	actionPlaintext = "plaintext"
+	actionDeny      = "deny"
+)
+
+// Policy applies an action to the keys matching any of its paths or its regular expression,
+// e.g. storing the public data, such as OCSP staples, in plaintext, or encrypting the private
+// keys with stronger key groups. The policies are evaluated in order by `Store` and `Load`, and
+// the first matching policy applies. The keys matching none of the policies are encrypted with
+// the providers of the storage.
+type Policy struct {
+	// The glob patterns of the keys, in the syntax of `path.Match`. A pattern without a
+	// slash matches the last segment of the key, e.g. `*.key` matches any private key.
+	Paths []string `json:"paths,omitempty"`
+
+	// The regular expression matching the keys, in RE2 syntax.
+	PathRegexp string `json:"path_regexp,omitempty"`
+
+	// The action applied to the matching keys: `encrypt`, with the providers of the policy
+	// or of the storage if the policy has none; `plaintext`, storing the data as-is, while
+	// the data stored encrypted before is still decrypted on load; or `deny`, failing to
+	// store, load, and stat the data. Default: `encrypt`.
+	Action string `json:"action,omitempty"`
+
+	// The encryption providers of the matching keys, in place of the providers of
+	// the storage. Only allowed with the `encrypt` action.
+	Encryption []json.RawMessage `json:"encryption,omitempty" caddy:"namespace=caddy.storage.encrypted.provider inline_key=provider"`
+
+	// The number of key groups of the policy required to decrypt the data.
+	// Default: all the key groups.
+	ShamirThreshold int `json:"shamir_threshold,omitempty"`
+
+	// The template of the tenant of the matching keys, e.g. the customer owning the domain
+	// of the certificate, resolved with the placeholders of the key: `{storage.key}`;
+	// `{storage.key.N}`, the N-th segment of the key, e.g. `{storage.key.2}` is the domain
+	// of `certificates/<issuer>/<domain>/<domain>.crt`; and `{storage.key.regexp.NAME}`,
+	// the capture group of `path_regexp` by name or number. Only allowed with the
+	// `encrypt` action.
+	Tenant string `json:"tenant,omitempty"`
+
+	// The encryption providers of each tenant by name. The keys of the tenants not listed
+	// are encrypted with the providers of the policy, or of the storage if the policy has none.
+	Tenants map[string]*Tenant `json:"tenants,omitempty"`
+
+	pathRegexp *regexp.Regexp
+	keyGroups  []sops.KeyGroup
+}
+
+// Tenant is the encryption providers of a tenant of a policy.
+type Tenant struct {
+	// The encryption providers of the keys of the tenant.
+	Encryption []json.RawMessage `json:"encryption,omitempty" caddy:"namespace=caddy.storage.encrypted.provider inline_key=provider"`
+
+	// The number of key groups of the tenant required to decrypt the data.
+	// Default: all the key groups.
+	ShamirThreshold int `json:"shamir_threshold,omitempty"`
+
+	keyGroups []sops.KeyGroup
+}
+
+// provision loads the providers of the tenant, returning their key service clients.
+func (t *Tenant) provision(ctx caddy.Context) (keyServiceRouter, error) {
+	if len(t.Encryption) == 0 {
+		return nil, errors.New("field 'encryption' cannot be empty")
+	}
+	iencrypt, err := ctx.LoadModule(t, "Encryption")
+	if err != nil {
+		return nil, err
+	}
+	var router keyServiceRouter
+	t.keyGroups, router = loadProviders(iencrypt.([]any))
+	if err := validateShamirThreshold(t.ShamirThreshold, len(t.keyGroups)); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// provision validates the policy and loads its providers, returning the key
+// service clients of the providers to decrypt the data encrypted by the policy.
+func (p *Policy) provision(ctx caddy.Context) (keyServiceRouter, error) {
+	switch p.Action {
+	case "":
+		p.Action = actionEncrypt
+	case actionEncrypt, actionPlaintext, actionDeny:
+	default:
+		return nil, fmt.Errorf("unrecognized action '%s'", p.Action)
+	}
+	if len(p.Paths) == 0 && p.PathRegexp == "" {
+		return nil, errors.New("either field 'paths' or 'path_regexp' must be specified")
+	}
+	for _, pattern := range p.Paths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad path pattern '%s': %v", pattern, err)
+		}
+	}
+	if p.PathRegexp != "" {
+		re, err := regexp.Compile(p.PathRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("bad path regexp '%s': %v", p.PathRegexp, err)
+		}
+		p.pathRegexp = re
+	}
+	if (p.Tenant == "") != (len(p.Tenants) == 0) {
+		return nil, errors.New("fields 'tenant' and 'tenants' must be specified together")
+	}
+	if p.Action != actionEncrypt && (len(p.Encryption) > 0 || p.Tenant != "") {
+		return nil, fmt.Errorf("fields 'encryption' and 'tenant' are only allowed with the '%s' action", actionEncrypt)
+	}
+	if len(p.Encryption) == 0 && p.ShamirThreshold != 0 {
+		return nil, errors.New("field 'shamir_threshold' requires field 'encryption'")
+	}
+	var router keyServiceRouter
+	if len(p.Encryption) > 0 {
+		iencrypt, err := ctx.LoadModule(p, "Encryption")
+		if err != nil {
+			return nil, err
+		}
+		var r keyServiceRouter
+		p.keyGroups, r = loadProviders(iencrypt.([]any))
+		if err := validateShamirThreshold(p.ShamirThreshold, len(p.keyGroups)); err != nil {
+			return nil, err
+		}
+		router = append(router, r...)
+	}
+	names := make([]string, 0, len(p.Tenants))
+	for name := range p.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := p.Tenants[name]
+		if t == nil {
+			return nil, fmt.Errorf("tenant %s: field 'encryption' cannot be empty", name)
+		}
+		r, err := t.provision(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", name, err)
+		}
+		router = append(router, r...)
+	}
+	return router, nil
+}
+
+// tenant returns the tenant of the key, resolving the placeholders of the `Tenant` template with the key.
+func (p *Policy) tenant(key string) string {
+	repl := caddy.NewEmptyReplacer()
+	repl.Map(func(name string) (any, bool) {
+		if name == "storage.key" {
+			return key, true
+		}
+		name, ok := strings.CutPrefix(name, "storage.key.")
+		if !ok {
+			return nil, false
+		}
+		if group, ok := strings.CutPrefix(name, "regexp."); ok {
+			if p.pathRegexp == nil {
+				return nil, false
+			}
+			match := p.pathRegexp.FindStringSubmatch(key)
+			i, err := strconv.Atoi(group)
+			if err != nil {
+				i = p.pathRegexp.SubexpIndex(group)
+			}
+			if i < 0 || i >= len(match) {
+				return nil, false
+			}
+			return match[i], true
+		}
+		i, err := strconv.Atoi(name)
+		if err != nil {
+			return nil, false
+		}
+		segments := strings.Split(key, "/")
+		if i < 0 || i >= len(segments) {
+			return nil, false
+		}
+		return segments[i], true
+	})
+	return repl.ReplaceAll(p.Tenant, "")
+}
+
+// matches reports whether the key matches any of the paths or the regular expression of the policy.
+func (p *Policy) matches(key string) bool {
+	for _, pattern := range p.Paths {
+		name := key
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(key)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return p.pathRegexp != nil && p.pathRegexp.MatchString(key)
+}
+
+// action returns the action of the policy, where no policy encrypts the data.
+func (p *Policy) action() string {
+	if p == nil {
+		return actionEncrypt
+	}
+	return p.Action
+}
+
+// policy returns the first policy matching the key, if any.
+func (s *Storage) policy(key string) *Policy {
+	for _, p := range s.Policies {
+		if p.matches(key) {
+			return p
+		}
+	}
+	return nil
+}
+
+// keyGroupsOf returns the key groups and the Shamir threshold to encrypt the data of the key with,
+// i.e. of the tenant of the key, falling back to the matching policy, then to the storage.
+func (s *Storage) keyGroupsOf(key string) ([]sops.KeyGroup, int) {
+	p := s.policy(key)
+	if p == nil {
+		return s.keyGroups, s.ShamirThreshold
+	}
+	if p.Tenant != "" {
+		if t, ok := p.Tenants[p.tenant(key)]; ok {
+			return t.keyGroups, t.ShamirThreshold
+		}
+	}
+	// only the policies of the `encrypt` action have key groups
+	if len(p.keyGroups) > 0 {
+		return p.keyGroups, p.ShamirThreshold
+	}
+	return s.keyGroups, s.ShamirThreshold
+}
@@ -0,0 +1,337 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestPolicyMatches(t *testing.T) {
+	testcases := []struct {
+		name   string
+		policy Policy
+		key    string
+		match  bool
+	}{
+		{
+			name:   "base name pattern",
+			policy: Policy{Paths: []string{"*.key"}},
+			key:    "certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.key",
+			match:  true,
+		},
+		{
+			name:   "base name pattern mismatch",
+			policy: Policy{Paths: []string{"*.key"}},
+			key:    "certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+			match:  false,
+		},
+		{
+			name:   "full path pattern",
+			policy: Policy{Paths: []string{"ocsp/*"}},
+			key:    "ocsp/example.com-1f3a",
+			match:  true,
+		},
+		{
+			name:   "full path pattern does not cross segments",
+			policy: Policy{Paths: []string{"acme/*"}},
+			key:    "acme/acme-v02.api.letsencrypt.org-directory/users/default/default.key",
+			match:  false,
+		},
+		{
+			name:   "any of the patterns",
+			policy: Policy{Paths: []string{"*.crt", "*.key"}},
+			key:    "certificates/example.com/example.com.key",
+			match:  true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy.matches(tc.key); got != tc.match {
+				t.Errorf("expected match %t, got %t", tc.match, got)
+			}
+		})
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	p := Policy{PathRegexp: `^acme/.+/users/`}
+	if _, err := p.provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !p.matches("acme/acme-v02.api.letsencrypt.org-directory/users/default/default.key") {
+		t.Error("expected the regexp to match")
+	}
+	if p.matches("certificates/acme-v02.api.letsencrypt.org-directory/users/users.key") {
+		t.Error("expected the regexp to not match")
+	}
+}
+
+func TestPolicyTenant(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	const certKey = "certificates/acme-v02.api.letsencrypt.org-directory/shop.customer-a.example.net/shop.customer-a.example.net.crt"
+	testcases := []struct {
+		name   string
+		policy Policy
+		key    string
+		tenant string
+	}{
+		{
+			name:   "key",
+			policy: Policy{Paths: []string{"*.crt"}, Tenant: "{storage.key}"},
+			key:    certKey,
+			tenant: certKey,
+		},
+		{
+			name:   "segment",
+			policy: Policy{Paths: []string{"*.crt"}, Tenant: "{storage.key.2}"},
+			key:    certKey,
+			tenant: "shop.customer-a.example.net",
+		},
+		{
+			name:   "segment out of range",
+			policy: Policy{Paths: []string{"*.crt"}, Tenant: "{storage.key.9}"},
+			key:    certKey,
+			tenant: "",
+		},
+		{
+			name:   "named capture group",
+			policy: Policy{PathRegexp: `^certificates/[^/]+/(?:[^/]+\.)?(?P<customer>[^./]+)\.example\.net/`, Tenant: "customer-{storage.key.regexp.customer}"},
+			key:    certKey,
+			tenant: "customer-customer-a",
+		},
+		{
+			name:   "numbered capture group",
+			policy: Policy{PathRegexp: `^certificates/([^/]+)/`, Tenant: "{storage.key.regexp.1}"},
+			key:    certKey,
+			tenant: "acme-v02.api.letsencrypt.org-directory",
+		},
+		{
+			name:   "unmatched regexp",
+			policy: Policy{Paths: []string{"*.crt"}, PathRegexp: `^acme/([^/]+)/`, Tenant: "{storage.key.regexp.1}"},
+			key:    certKey,
+			tenant: "",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.policy.Tenants = map[string]*Tenant{"unused": {Encryption: []json.RawMessage{json.RawMessage(fmt.Sprintf(`{"provider": "local", "keys": [%s]}`, ageKey(recipient)))}}}
+			if _, err := tc.policy.provision(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got := tc.policy.tenant(tc.key); got != tc.tenant {
+				t.Errorf("expected tenant %q, got %q", tc.tenant, got)
+			}
+		})
+	}
+}
+
+func TestStorageTenants(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{
+		"encryption": [{"provider": "local", "keys": [%s]}],
+		"policies": [
+			{"paths": ["certificates/*/*/*"], "tenant": "{storage.key.2}", "tenants": {
+				"example.com": {"encryption": [{"provider": "local", "keys": [%s]}]},
+				"example.org": {"encryption": [{"provider": "local", "keys": [%s]}]}
+			}}
+		]
+	}`, ageKey(recipient, ageId), ageKey(recipient2, ageId2), ageKey(recipient3, ageId3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcases := []struct {
+		key       string
+		recipient string
+	}{
+		{key: "certificates/acme/example.com/example.com.key", recipient: recipient2},
+		{key: "certificates/acme/example.org/example.org.key", recipient: recipient3},
+		// the tenants not listed, and the keys outside of the policy, fall back to the storage keys
+		{key: "certificates/acme/example.net/example.net.key", recipient: recipient},
+		{key: "acme/acme/users/default/default.key", recipient: recipient},
+	}
+	for _, tc := range testcases {
+		if err := s.Store(ctx, tc.key, []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := s.backend.Load(ctx, tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []string{recipient, recipient2, recipient3} {
+			if bytes.Contains(raw, []byte(r)) != (r == tc.recipient) {
+				t.Errorf("%s: expected the data to be encrypted to %s only: %s", tc.key, tc.recipient, raw)
+			}
+		}
+		data, err := s.Load(ctx, tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != val {
+			t.Errorf("%s: data mismatch: %s != %s", tc.key, data, val)
+		}
+	}
+}
+
+func TestStoragePolicies(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{
+		"encryption": [{"provider": "local", "keys": [%s]}],
+		"policies": [
+			{"paths": ["*.crt", "ocsp/*"], "action": "plaintext"},
+			{"paths": ["backups/*"], "action": "deny"},
+			{"paths": ["*.key"], "encryption": [{"provider": "local", "keys": [%s]}]}
+		]
+	}`, ageKey(recipient, ageId), ageKey(recipient2, ageId2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noPolicies, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		crtKey = "certificates/example.com/example.com.crt"
+		keyKey = "certificates/example.com/example.com.key"
+	)
+	for _, k := range []string{crtKey, keyKey, key} {
+		if err := s.Store(ctx, k, []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := s.Load(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != val {
+			t.Errorf("%s: data mismatch: %s != %s", k, data, val)
+		}
+	}
+
+	// the public data is stored as-is
+	raw, err := s.backend.Load(ctx, crtKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != val {
+		t.Errorf("expected the data to be stored in plaintext: %s", raw)
+	}
+
+	// the private keys are encrypted with the keys of the policy only
+	raw, err = s.backend.Load(ctx, keyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte(recipient2)) || bytes.Contains(raw, []byte(recipient)) {
+		t.Errorf("expected the data to be encrypted to the policy keys only: %s", raw)
+	}
+	if _, err := noPolicies.Load(ctx, keyKey); !errors.Is(err, ErrDecryption) {
+		t.Errorf("expected the data to not decrypt with the storage keys: %v", err)
+	}
+	raw, err = s.backend.Load(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, []byte(recipient)) || bytes.Contains(raw, []byte(recipient2)) {
+		t.Errorf("expected the data to be encrypted to the storage keys only: %s", raw)
+	}
+
+	// the denied keys are neither stored nor loaded
+	if err := s.Store(ctx, "backups/example.com.tar", []byte(val)); !errors.Is(err, ErrDenied) {
+		t.Errorf("expected storing to be denied: %v", err)
+	}
+	if s.Exists(ctx, "backups/example.com.tar") {
+		t.Error("the denied data is stored")
+	}
+	if err := noPolicies.Store(ctx, "backups/example.com.tar", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(ctx, "backups/example.com.tar"); !errors.Is(err, ErrDenied) {
+		t.Errorf("expected loading to be denied: %v", err)
+	}
+
+	// the data encrypted before the plaintext policy still loads
+	if err := noPolicies.Store(ctx, "ocsp/example.com-1f3a", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.Load(ctx, "ocsp/example.com-1f3a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != val {
+		t.Errorf("data mismatch: %s != %s", data, val)
+	}
+	// while plaintext data elsewhere does not
+	if err := s.backend.Store(ctx, "plaintext", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load(ctx, "plaintext"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected plaintext data outside of the policy to fail: %v", err)
+	}
+}
+
+func TestStoragePoliciesProvision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	testcases := []struct {
+		name   string
+		policy string
+	}{
+		{
+			name:   "unrecognized action",
+			policy: `{"paths": ["*.crt"], "action": "ignore"}`,
+		},
+		{
+			name:   "no paths",
+			policy: `{"action": "plaintext"}`,
+		},
+		{
+			name:   "bad pattern",
+			policy: `{"paths": ["[.crt"], "action": "plaintext"}`,
+		},
+		{
+			name:   "bad regexp",
+			policy: `{"path_regexp": "(", "action": "plaintext"}`,
+		},
+		{
+			name:   "providers of plaintext",
+			policy: fmt.Sprintf(`{"paths": ["*.crt"], "action": "plaintext", "encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient)),
+		},
+		{
+			name:   "threshold without providers",
+			policy: `{"paths": ["*.key"], "shamir_threshold": 2}`,
+		},
+		{
+			name:   "tenant without tenants",
+			policy: `{"paths": ["*.key"], "tenant": "{storage.key.2}"}`,
+		},
+		{
+			name:   "tenant of plaintext",
+			policy: fmt.Sprintf(`{"paths": ["*.crt"], "action": "plaintext", "tenant": "{storage.key.2}", "tenants": {"example.com": {"encryption": [{"provider": "local", "keys": [%s]}]}}}`, ageKey(recipient)),
+		},
+		{
+			name:   "tenant without providers",
+			policy: `{"paths": ["*.key"], "tenant": "{storage.key.2}", "tenants": {"example.com": {}}}`,
+		},
+		{
+			name:   "threshold out of range",
+			policy: fmt.Sprintf(`{"paths": ["*.key"], "shamir_threshold": 3, "encryption": [{"provider": "local", "keys": [%s, %s]}]}`, ageKey(recipient), ageKey(recipient2)),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := provisionStorage(ctx, t.TempDir(), fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}], "policies": [%s]}`, ageKey(recipient, ageId), tc.policy))
+			if err == nil {
+				t.Error("expected provisioning to fail")
+			}
+		})
+	}
+}
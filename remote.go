@@ -2,27 +2,72 @@ package encryptedstorage
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/keys"
 	"github.com/getsops/sops/v3/keyservice"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/credentials/local"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
 )
 
 func init() {
 	caddy.RegisterModule(Remote{})
 }
 
+// Remote encryption provider delegates the encryption/decryption of the data key
+// to a SOPS key service reachable over gRPC. The configured keys are sent to the
+// key service alongside the data key, so only the public/identifying parts of the
+// keys are needed on this end; the key service holds the secrets.
+// See more: [https://github.com/getsops/sops#key-service](https://github.com/getsops/sops#key-service)
 type Remote struct {
+	// The address of the key service, e.g. `keyservice.internal:5000`. Unix domain
+	// sockets are addressed as `unix:///path/to/socket` (or `unix:relative/path`)
+	// and abstract sockets as `unix-abstract:name`.
 	Address string `json:"address,omitempty"`
 
-	Keys       []json.RawMessage `json:"keys,omitempty" caddy:"namespace=caddy.storage.encrypted.key inline_key=type"`
+	// The TLS configuration of the connection to the key service. If omitted,
+	// the connection is secured by TLS verified against the system trust store,
+	// except for Unix domain sockets which are trusted as local connections.
+	TLS *RemoteTLS `json:"tls,omitempty"`
+
+	// Connect to the key service over plaintext, without transport security.
+	// This exposes the data keys on the wire; only use it for local development.
+	Insecure bool `json:"insecure,omitempty"`
+
+	// How long to wait for the connection to the key service to be established.
+	// Default: no timeout.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	// The user ID the key service process must run as. The ID is obtained from
+	// the kernel (`SO_PEERCRED`) upon connecting, and the connection is rejected
+	// on mismatch. Only applicable to Unix domain sockets on Linux.
+	PeerUID *int `json:"peer_uid,omitempty"`
+
+	// The keyset the key service is asked to encrypt/decrypt with. Each key is a key group of its own.
+	Keys []json.RawMessage `json:"keys,omitempty" caddy:"namespace=caddy.storage.encrypted.key inline_key=type"`
+
+	// The keyset the key service is asked to encrypt/decrypt with arranged into
+	// key groups. Any key of a key group can unlock the group.
+	KeyGroups  [][]json.RawMessage `json:"key_groups,omitempty" caddy:"namespace=caddy.storage.encrypted.key inline_key=type"`
 	keysGroups []sops.KeyGroup
 
+	// The keys the key service is only asked to decrypt with, e.g. the retired keys
+	// during key rotation. The key service must still hold them.
+	LegacyKeys []json.RawMessage `json:"legacy_keys,omitempty" caddy:"namespace=caddy.storage.encrypted.key inline_key=type"`
+	legacyKeys []keys.MasterKey
+
 	ctx  context.Context
 	conn *grpc.ClientConn
 }
@@ -32,15 +77,20 @@ func (r *Remote) KeyServiceClient() keyservice.KeyServiceClient {
 	return keyservice.NewKeyServiceClient(r.conn)
 }
 
-// KeyGroup implements KeyGroupGetter.
+// KeyGroup implements KeyGroupProvider.
 func (r *Remote) KeyGroup() []sops.KeyGroup {
 	return r.keysGroups
 }
 
+// LegacyMasterkeys implements LegacyKeyProvider.
+func (r *Remote) LegacyMasterkeys() []keys.MasterKey {
+	return r.legacyKeys
+}
+
 // CaddyModule implements caddy.Module.
 func (Remote) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID: "caddy.storage.encrypted.remote",
+		ID: "caddy.storage.encrypted.provider.remote",
 		New: func() caddy.Module {
 			return new(Remote)
 		},
@@ -50,21 +100,35 @@ func (Remote) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (r *Remote) Provision(ctx caddy.Context) error {
 	r.ctx = ctx
-	if len(r.Keys) == 0 {
-		return errors.New("field 'keys' cannot be empty")
+	if len(r.Address) == 0 {
+		return errors.New("field 'address' cannot be empty")
 	}
-	iKeys, err := ctx.LoadModule(r, "Keys")
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	r.Address = repl.ReplaceKnown(r.Address, "")
+	if r.PeerUID != nil {
+		if !isUnixAddress(r.Address) {
+			return errors.New("field 'peer_uid' is only applicable to Unix domain socket addresses")
+		}
+		if !peerCredSupported {
+			return errors.New("field 'peer_uid' is not supported on this platform")
+		}
+	}
+	kgs, _, err := loadKeyGroups(ctx, r, r.Keys, r.KeyGroups)
 	if err != nil {
 		return err
 	}
-	for _, iKey := range iKeys.([]any) {
-		key, ok := iKey.(MasterkeyConverter)
-		if !ok {
-			return fmt.Errorf("expected key to be of type sops.Key, but got %T", iKey)
-		}
-		r.keysGroups = append(r.keysGroups, sops.KeyGroup{key.ToMasterkey()})
+	r.keysGroups = kgs
+	if r.legacyKeys, _, err = loadLegacyKeys(ctx, r, r.LegacyKeys); err != nil {
+		return err
 	}
-	c, err := grpc.NewClient(r.Address)
+	creds, err := r.transportCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	c, err := grpc.NewClient(r.Address, grpc.WithTransportCredentials(creds), grpc.WithContextDialer(r.dial))
 	if err != nil {
 		return fmt.Errorf("failed to connect to key service: %v", err)
 	}
@@ -72,16 +136,151 @@ func (r *Remote) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+func (r *Remote) transportCredentials(ctx caddy.Context) (credentials.TransportCredentials, error) {
+	if r.Insecure {
+		if r.TLS != nil {
+			return nil, errors.New("fields 'tls' and 'insecure' are mutually exclusive")
+		}
+		return insecure.NewCredentials(), nil
+	}
+	if r.TLS == nil && isUnixAddress(r.Address) {
+		return local.NewCredentials(), nil
+	}
+	if r.TLS == nil {
+		return credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12}), nil
+	}
+	cfg, err := r.TLS.makeTLSConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+// dial connects to the key service at the address as resolved by gRPC. Unix domain
+// sockets are passed as `unix://` or `unix:` prefixed paths, and `unix-abstract:` targets
+// as `unix:@name`, the `@` prefix of which the net package dials as an abstract socket.
+func (r *Remote) dial(ctx context.Context, addr string) (net.Conn, error) {
+	network := "tcp"
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "unix:"):
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	d := net.Dialer{Timeout: time.Duration(r.DialTimeout)}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.PeerUID == nil {
+		return conn, nil
+	}
+	uid, err := peerUID(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("obtaining key service peer credentials: %v", err)
+	}
+	if uid != *r.PeerUID {
+		conn.Close()
+		return nil, fmt.Errorf("key service is run by user ID %d, expected %d", uid, *r.PeerUID)
+	}
+	return conn, nil
+}
+
+func isUnixAddress(addr string) bool {
+	return strings.HasPrefix(addr, "unix:") || strings.HasPrefix(addr, "unix-abstract:")
+}
+
+// RemoteTLS configures the TLS connection to the key service
+type RemoteTLS struct {
+	// Certificate authority module which provides the certificate pool of
+	// trusted certificates, e.g. `file` for a CA bundle or `pki_root` for
+	// the root of a CA in Caddy's `pki` app. Defaults to the system trust store.
+	CARaw json.RawMessage `json:"ca,omitempty" caddy:"namespace=tls.ca_pool.source inline_key=provider"`
+
+	// PEM-encoded client certificate filename to present to the key service.
+	ClientCertificateFile string `json:"client_certificate_file,omitempty"`
+
+	// PEM-encoded key to use with the client certificate.
+	ClientCertificateKeyFile string `json:"client_certificate_key_file,omitempty"`
+
+	// The subject name of a certificate in the certificate cache of Caddy's
+	// `tls` app to present as client certificate, e.g. one loaded through
+	// `load_files`. The certificate is looked up during the handshake.
+	// Beware the certificates obtained by the `tls` app are persisted in this
+	// very storage, so they cannot be used to bootstrap the connection.
+	ClientCertificateName string `json:"client_certificate_name,omitempty"`
+
+	// The server name used when verifying the certificate received in the TLS
+	// handshake. By default, the host part of the address is used.
+	ServerName string `json:"server_name,omitempty"`
+}
+
+func (t *RemoteTLS) makeTLSConfig(ctx caddy.Context) (*tls.Config, error) {
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: repl.ReplaceKnown(t.ServerName, ""),
+	}
+
+	certFile := repl.ReplaceKnown(t.ClientCertificateFile, "")
+	keyFile := repl.ReplaceKnown(t.ClientCertificateKeyFile, "")
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("fields 'client_certificate_file' and 'client_certificate_key_file' must be specified together")
+	}
+	if certFile != "" && t.ClientCertificateName != "" {
+		return nil, errors.New("fields 'client_certificate_file' and 'client_certificate_name' are mutually exclusive")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate key pair: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if t.ClientCertificateName != "" {
+		name := repl.ReplaceKnown(t.ClientCertificateName, "")
+		cfg.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			for _, cert := range caddytls.AllMatchingCertificates(name) {
+				certificate := cert.Certificate
+				if err := cri.SupportsCertificate(&certificate); err == nil {
+					return &certificate, nil
+				}
+			}
+			return nil, fmt.Errorf("no client certificate found for name: %s", name)
+		}
+	}
+
+	if t.CARaw != nil {
+		caRaw, err := ctx.LoadModule(t, "CARaw")
+		if err != nil {
+			return nil, fmt.Errorf("loading ca module: %v", err)
+		}
+		ca, ok := caRaw.(caddytls.CA)
+		if !ok {
+			return nil, fmt.Errorf("CA module '%T' is not a certificate pool provider", caRaw)
+		}
+		cfg.RootCAs = ca.CertPool()
+	}
+	return cfg, nil
+}
+
 // Cleanup implements caddy.CleanerUpper.
 func (r *Remote) Cleanup() error {
+	if r.conn == nil {
+		return nil
+	}
 	return r.conn.Close()
 }
 
 var (
-	_ caddy.Module       = (*Remote)(nil)
-	_ caddy.Provisioner  = (*Remote)(nil)
-	_ caddy.CleanerUpper = (*Remote)(nil)
-	// _ keyservice.KeyServiceServer = (*Remote)(nil)
+	_ caddy.Module             = (*Remote)(nil)
+	_ caddy.Provisioner        = (*Remote)(nil)
+	_ caddy.CleanerUpper       = (*Remote)(nil)
 	_ KeyGroupProvider         = (*Remote)(nil)
+	_ LegacyKeyProvider        = (*Remote)(nil)
 	_ KeyServiceClientProvider = (*Remote)(nil)
 )
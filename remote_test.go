@@ -0,0 +1,377 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// startKeyService serves a `Local` provider holding the age identity as a SOPS key service
+// over the given gRPC server, returning the address it listens on.
+func startKeyService(t *testing.T, srv *grpc.Server, network, address string) string {
+	t.Helper()
+	return startKeyServiceWithKeys(t, srv, network, address, fmt.Sprintf(`[{"type":"age", "recipient": "%s", "identities": ["%s"]}]`, recipient, ageId))
+}
+
+// startKeyServiceWithKeys is like startKeyService, but with the given JSON array of keys.
+func startKeyServiceWithKeys(t *testing.T, srv *grpc.Server, network, address, keys string) string {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	l := new(Local)
+	if err := json.Unmarshal([]byte(fmt.Sprintf(`{"keys": %s}`, keys)), l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning key service: %s", err)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	keyservice.RegisterKeyServiceServer(srv, l)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Stop)
+	return ln.Addr().String()
+}
+
+func TestStorageWithRemoteProvider(t *testing.T) {
+	addr := startKeyService(t, grpc.NewServer(), "tcp", "127.0.0.1:0")
+	dir := t.TempDir()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s := Storage{
+		RawBackend: json.RawMessage(fmt.Sprintf(`{"module": "file_system", "root": "%s"}`, filepath.ToSlash(dir))),
+		// the identity is only known to the key service
+		Encryption: []json.RawMessage{json.RawMessage(fmt.Sprintf(`{"provider":"remote", "address": "%s", "insecure": true, "keys": [{"type":"age", "recipient": "%s"}]}`, addr, recipient))},
+	}
+	if err := s.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %s", err)
+	}
+	if err := s.Store(ctx, key, []byte(val)); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	fdata, err := os.ReadFile(filepath.Join(dir, key))
+	if err != nil {
+		t.Fatalf("error reading file: %s", err)
+	}
+	if bytes.Contains(fdata, []byte(val)) {
+		t.Fatalf("file data should not contain '%s'", val)
+	}
+	data, err := s.Load(ctx, key)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if string(data) != val {
+		t.Fatalf("load: data mismatch: %s != %s", data, val)
+	}
+}
+
+func TestRemoteProvisionRequiresAddress(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	r := &Remote{
+		Keys: []json.RawMessage{json.RawMessage(fmt.Sprintf(`{"type":"age", "recipient": "%s"}`, recipient))},
+	}
+	if err := r.Provision(ctx); err == nil {
+		t.Fatal("expected error for missing address")
+	}
+}
+
+// testPKI is a throwaway CA with a server and a client certificate issued by it, written as PEM files.
+type testPKI struct {
+	caFile, serverCertFile, serverKeyFile, clientCertFile, clientKeyFile string
+	pool                                                                 *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	p := testPKI{pool: x509.NewCertPool()}
+	p.pool.AddCert(caCert)
+	p.caFile = writePEM(t, dir, "ca.pem", "CERTIFICATE", caDER)
+
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writePEM(t, dir, name+".pem", "CERTIFICATE", der), writePEM(t, dir, name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	}
+	p.serverCertFile, p.serverKeyFile = issue("keyservice.test", 2, x509.ExtKeyUsageServerAuth)
+	p.clientCertFile, p.clientKeyFile = issue("edge.test", 3, x509.ExtKeyUsageClientAuth)
+	return p
+}
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	t.Helper()
+	fp := filepath.Join(dir, name)
+	if err := os.WriteFile(fp, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fp
+}
+
+func TestStorageWithRemoteProviderOverMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	serverCert, err := tls.LoadX509KeyPair(pki.serverCertFile, pki.serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startKeyService(t, grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.pool,
+	}))), "tcp", "127.0.0.1:0")
+
+	testcases := []struct {
+		name  string
+		tls   string
+		fails bool
+	}{
+		{
+			name: "mutual tls",
+			tls:  fmt.Sprintf(`{"ca": {"provider": "file", "pem_files": [%q]}, "client_certificate_file": %q, "client_certificate_key_file": %q, "server_name": "keyservice.test"}`, pki.caFile, pki.clientCertFile, pki.clientKeyFile),
+		},
+		{
+			name:  "missing client certificate",
+			tls:   fmt.Sprintf(`{"ca": {"provider": "file", "pem_files": [%q]}, "server_name": "keyservice.test"}`, pki.caFile),
+			fails: true,
+		},
+		{
+			name:  "untrusted server",
+			tls:   fmt.Sprintf(`{"client_certificate_file": %q, "client_certificate_key_file": %q, "server_name": "keyservice.test"}`, pki.clientCertFile, pki.clientKeyFile),
+			fails: true,
+		},
+		{
+			name:  "server name mismatch",
+			tls:   fmt.Sprintf(`{"ca": {"provider": "file", "pem_files": [%q]}, "client_certificate_file": %q, "client_certificate_key_file": %q, "server_name": "other.test"}`, pki.caFile, pki.clientCertFile, pki.clientKeyFile),
+			fails: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			s := Storage{
+				RawBackend: json.RawMessage(fmt.Sprintf(`{"module": "file_system", "root": "%s"}`, filepath.ToSlash(t.TempDir()))),
+				Encryption: []json.RawMessage{json.RawMessage(fmt.Sprintf(`{"provider":"remote", "address": "%s", "tls": %s, "keys": [{"type":"age", "recipient": "%s"}]}`, addr, tc.tls, recipient))},
+			}
+			if err := s.Provision(ctx); err != nil {
+				t.Fatalf("error provisioning: %s", err)
+			}
+			err := s.Store(ctx, key, []byte(val))
+			if tc.fails {
+				if err == nil {
+					t.Fatal("expected store to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("store: %s", err)
+			}
+			data, err := s.Load(ctx, key)
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if string(data) != val {
+				t.Fatalf("load: data mismatch: %s != %s", data, val)
+			}
+		})
+	}
+}
+
+func TestRemoteProvisionTransportConflicts(t *testing.T) {
+	testcases := []struct {
+		name   string
+		config string
+	}{
+		{
+			name:   "tls and insecure",
+			config: `{"address": "127.0.0.1:1", "insecure": true, "tls": {"server_name": "keyservice.test"}}`,
+		},
+		{
+			name:   "client certificate without key",
+			config: `{"address": "127.0.0.1:1", "tls": {"client_certificate_file": "cert.pem"}}`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			r := new(Remote)
+			if err := json.Unmarshal([]byte(tc.config), r); err != nil {
+				t.Fatal(err)
+			}
+			r.Keys = []json.RawMessage{json.RawMessage(fmt.Sprintf(`{"type":"age", "recipient": "%s"}`, recipient))}
+			if err := r.Provision(ctx); err == nil {
+				t.Fatal("expected provisioning error")
+			}
+		})
+	}
+}
+
+// roundTripRemote stores and loads the test value through the `encrypted` storage using the given `remote` provider config.
+func roundTripRemote(t *testing.T, provider string) error {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	s := Storage{
+		RawBackend: json.RawMessage(fmt.Sprintf(`{"module": "file_system", "root": "%s"}`, filepath.ToSlash(t.TempDir()))),
+		Encryption: []json.RawMessage{json.RawMessage(provider)},
+	}
+	if err := s.Provision(ctx); err != nil {
+		return fmt.Errorf("provision: %v", err)
+	}
+	if err := s.Store(ctx, key, []byte(val)); err != nil {
+		return fmt.Errorf("store: %v", err)
+	}
+	data, err := s.Load(ctx, key)
+	if err != nil {
+		return fmt.Errorf("load: %v", err)
+	}
+	if string(data) != val {
+		return fmt.Errorf("load: data mismatch: %s != %s", data, val)
+	}
+	return nil
+}
+
+func TestStorageWithRemoteProviderLegacyKeys(t *testing.T) {
+	srv := grpc.NewServer()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	l := new(Local)
+	cfg := fmt.Sprintf(`{"keys": [%s], "legacy_keys": [%s]}`, ageKey(recipient2, ageId2), ageKey(recipient, ageId))
+	if err := json.Unmarshal([]byte(cfg), l); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyservice.RegisterKeyServiceServer(srv, l)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Stop)
+
+	// data written under the retired key locally is read through the key service
+	store := fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient))
+	load := fmt.Sprintf(`{"encryption": [{"provider": "remote", "address": %q, "insecure": true, "keys": [%s], "legacy_keys": [%s]}]}`,
+		ln.Addr().String(), ageKey(recipient2), ageKey(recipient))
+	if err := storeAndLoad(t, t.TempDir(), store, load); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageWithRemoteProviderOverUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not exercised on Windows")
+	}
+	// keep the path short to stay within the socket path length limit
+	dir, err := os.MkdirTemp("", "ks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "ks.sock")
+	startKeyService(t, grpc.NewServer(), "unix", sock)
+
+	keys := fmt.Sprintf(`[{"type":"age", "recipient": "%s"}]`, recipient)
+	if err := roundTripRemote(t, fmt.Sprintf(`{"provider":"remote", "address": "unix://%s", "keys": %s}`, sock, keys)); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	t.Run("peer uid", func(t *testing.T) {
+		if err := roundTripRemote(t, fmt.Sprintf(`{"provider":"remote", "address": "unix://%s", "peer_uid": %d, "keys": %s}`, sock, os.Getuid(), keys)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("peer uid mismatch", func(t *testing.T) {
+		if err := roundTripRemote(t, fmt.Sprintf(`{"provider":"remote", "address": "unix://%s", "peer_uid": %d, "keys": %s}`, sock, os.Getuid()+1, keys)); err == nil {
+			t.Fatal("expected the key service to be rejected")
+		}
+	})
+	t.Run("abstract socket", func(t *testing.T) {
+		name := fmt.Sprintf("caddy-encrypted-storage-%d", time.Now().UnixNano())
+		startKeyService(t, grpc.NewServer(), "unix", "@"+name)
+		if err := roundTripRemote(t, fmt.Sprintf(`{"provider":"remote", "address": "unix-abstract:%s", "peer_uid": %d, "keys": %s}`, name, os.Getuid(), keys)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRemoteProvisionPeerUIDRequiresUnixSocket(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	uid := 0
+	r := &Remote{
+		Address: "127.0.0.1:5000",
+		PeerUID: &uid,
+		Keys:    []json.RawMessage{json.RawMessage(fmt.Sprintf(`{"type":"age", "recipient": "%s"}`, recipient))},
+	}
+	if err := r.Provision(ctx); err == nil {
+		t.Fatal("expected error for peer_uid on a TCP address")
+	}
+}
@@ -0,0 +1,114 @@
+package encryptedstorage
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// rewriteQueueSize is the number of rewrites waiting for a worker, beyond which
+	// the rewrites are dropped, to be queued again once their keys are loaded again.
+	rewriteQueueSize = 128
+
+	// rewriteWorkers is the number of rewrites running concurrently.
+	rewriteWorkers = 2
+)
+
+// rewriteQueue rewrites the data loaded by `Load` in the background, i.e. re-encrypts it with
+// the current key groups or stores the migrated plaintext data encrypted, so loading does not
+// wait for the key services and the backend lock. Each key is queued at most once at a time.
+type rewriteQueue struct {
+	logger *zap.Logger
+
+	jobs    chan rewriteJob
+	start   sync.Once
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	// the keys queued or being rewritten, and the count of them to wait for
+	mu      sync.Mutex
+	pending map[string]struct{}
+	running sync.WaitGroup
+}
+
+type rewriteJob struct {
+	key     string
+	rewrite func(ctx context.Context)
+}
+
+func newRewriteQueue(logger *zap.Logger) *rewriteQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &rewriteQueue{
+		logger:  logger,
+		jobs:    make(chan rewriteJob, rewriteQueueSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		pending: make(map[string]struct{}),
+	}
+}
+
+// enqueue queues the rewrite of the key, unless the key is queued already, the queue is
+// full, or the queue is stopped. The workers are started with the first rewrite queued.
+func (q *rewriteQueue) enqueue(key string, rewrite func(ctx context.Context)) {
+	q.start.Do(func() {
+		for i := 0; i < rewriteWorkers; i++ {
+			q.workers.Add(1)
+			go q.work()
+		}
+	})
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[key]; ok || q.ctx.Err() != nil {
+		return
+	}
+	select {
+	case q.jobs <- rewriteJob{key: key, rewrite: rewrite}:
+		q.pending[key] = struct{}{}
+		q.running.Add(1)
+	default:
+		q.logger.Debug("rewrite queue is full, skipping", zap.String("key", key))
+	}
+}
+
+func (q *rewriteQueue) work() {
+	defer q.workers.Done()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case job := <-q.jobs:
+			job.rewrite(q.ctx)
+			q.mu.Lock()
+			delete(q.pending, job.key)
+			q.mu.Unlock()
+			q.running.Done()
+		}
+	}
+}
+
+// wait waits for the queued rewrites to finish.
+func (q *rewriteQueue) wait() {
+	q.running.Wait()
+}
+
+// stop cancels the running rewrites, drops the queued ones, and waits for the workers to exit.
+func (q *rewriteQueue) stop() {
+	q.mu.Lock()
+	q.cancel()
+	q.mu.Unlock()
+	q.workers.Wait()
+	for {
+		select {
+		case job := <-q.jobs:
+			q.mu.Lock()
+			delete(q.pending, job.key)
+			q.mu.Unlock()
+			q.running.Done()
+		default:
+			return
+		}
+	}
+}
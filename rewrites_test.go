@@ -0,0 +1,63 @@
+package encryptedstorage
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRewriteQueue(t *testing.T) {
+	q := newRewriteQueue(zap.NewNop())
+	var rewrites atomic.Int32
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+	// occupy all the workers, so the rewrites below are queued
+	for i := 0; i < rewriteWorkers; i++ {
+		q.enqueue(string(rune('a'+i)), func(ctx context.Context) {
+			blocked <- struct{}{}
+			<-release
+		})
+	}
+	for i := 0; i < rewriteWorkers; i++ {
+		<-blocked
+	}
+
+	// a key is queued once at a time
+	for i := 0; i < 3; i++ {
+		q.enqueue("key", func(context.Context) { rewrites.Add(1) })
+	}
+	// the rewrites beyond the size of the queue are dropped
+	for i := 0; i < rewriteQueueSize+1; i++ {
+		q.enqueue(string(rune(0x100+i)), func(context.Context) {})
+	}
+	close(release)
+	q.wait()
+	if n := rewrites.Load(); n != 1 {
+		t.Errorf("expected the key to be rewritten once, got %d", n)
+	}
+
+	// the key is queued again once rewritten
+	q.enqueue("key", func(context.Context) { rewrites.Add(1) })
+	q.wait()
+	if n := rewrites.Load(); n != 2 {
+		t.Errorf("expected the key to be rewritten again, got %d", n)
+	}
+
+	// the running rewrites are canceled once stopped, and nothing is queued after
+	canceled := make(chan struct{})
+	q.enqueue("running", func(ctx context.Context) {
+		blocked <- struct{}{}
+		<-ctx.Done()
+		close(canceled)
+	})
+	<-blocked
+	q.stop()
+	<-canceled
+	q.enqueue("key", func(context.Context) { rewrites.Add(1) })
+	q.wait()
+	if n := rewrites.Load(); n != 2 {
+		t.Errorf("expected no rewrite after stopping, got %d", n)
+	}
+}
@@ -0,0 +1,223 @@
+package encryptedstorage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// rotation re-encrypts the data of the `encrypted` storage with newly generated
+// data keys, which are encrypted with the current key groups of the storage.
+type rotation struct {
+	storage *Storage
+
+	// report the data to be rotated without rewriting it
+	dryRun bool
+
+	// the number of keys rotated concurrently
+	concurrency int
+
+	// the file listing the keys already rotated, one per line. The keys listed
+	// are skipped, and the keys rotated are appended, so an interrupted rotation
+	// can be resumed.
+	progressFile string
+}
+
+// rotationSummary is the outcome of a rotation.
+type rotationSummary struct {
+	// the keys rotated, or to be rotated in a dry run, including the encrypted
+	// data of the keys of `plaintext` policies, which is rewritten in plaintext
+	rotated []string
+
+	// the keys skipped for not being encrypted data, e.g. directories and locks,
+	// or for matching a `deny` policy
+	skipped []string
+
+	// the keys skipped for holding plaintext data which is to be encrypted, e.g. persisted
+	// before enabling encryption, i.e. neither a lock nor matching a `plaintext` policy
+	plaintext []string
+
+	// the keys skipped for being listed in the progress file
+	resumed []string
+
+	// the keys failed to rotate along with the reason
+	failed map[string]error
+}
+
+func (r *rotation) run(ctx context.Context) (*rotationSummary, error) {
+	done, err := r.loadProgress()
+	if err != nil {
+		return nil, err
+	}
+	var progress *os.File
+	if r.progressFile != "" && !r.dryRun {
+		progress, err = os.OpenFile(r.progressFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("opening progress file: %v", err)
+		}
+		defer progress.Close()
+	}
+	keys, err := r.storage.List(ctx, "", true)
+	if err != nil {
+		return nil, fmt.Errorf("listing keys: %v", err)
+	}
+	sort.Strings(keys)
+
+	summary := &rotationSummary{failed: make(map[string]error)}
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		jobs      = make(chan string)
+		writeErrs []error
+	)
+	concurrency := r.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				outcome, err := r.rotate(ctx, key)
+				mu.Lock()
+				switch {
+				case err != nil:
+					summary.failed[key] = err
+				case outcome == rotationRotated:
+					summary.rotated = append(summary.rotated, key)
+				case outcome == rotationPlaintext:
+					summary.plaintext = append(summary.plaintext, key)
+				default:
+					summary.skipped = append(summary.skipped, key)
+				}
+				if err == nil && progress != nil {
+					if _, err := fmt.Fprintln(progress, key); err != nil {
+						writeErrs = append(writeErrs, err)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, key := range keys {
+		if done[key] {
+			summary.resumed = append(summary.resumed, key)
+			continue
+		}
+		select {
+		case jobs <- key:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Strings(summary.rotated)
+	sort.Strings(summary.skipped)
+	sort.Strings(summary.plaintext)
+	if o, ok := r.storage.backend.(*obfuscatedStorage); ok && !r.dryRun && ctx.Err() == nil {
+		if err := o.rotateIndex(ctx); err != nil {
+			summary.failed["name index"] = err
+		}
+	}
+	if len(writeErrs) > 0 {
+		return summary, fmt.Errorf("writing progress file: %v", errors.Join(writeErrs...))
+	}
+	return summary, ctx.Err()
+}
+
+// rotationOutcome is the outcome of rotating a key.
+type rotationOutcome int
+
+const (
+	rotationSkipped rotationOutcome = iota
+	rotationRotated
+	rotationPlaintext
+)
+
+// rotate re-encrypts the data of the key while holding its lock, and reports whether
+// the key holds encrypted data, or plaintext data to be encrypted. The data of the keys
+// matching a `plaintext` policy is decrypted instead, and the keys matching a `deny`
+// policy are skipped.
+func (r *rotation) rotate(ctx context.Context, key string) (rotationOutcome, error) {
+	s := r.storage
+	policy := s.policy(key)
+	if policy.action() == actionDeny {
+		return rotationSkipped, nil
+	}
+	info, err := s.backend.Stat(ctx, key)
+	if err != nil {
+		return rotationSkipped, err
+	}
+	if !info.IsTerminal {
+		return rotationSkipped, nil
+	}
+	if !r.dryRun {
+		if err := s.backend.Lock(ctx, key); err != nil {
+			return rotationSkipped, fmt.Errorf("acquiring lock: %v", err)
+		}
+		defer func() {
+			_ = s.backend.Unlock(ctx, key)
+		}()
+	}
+	bs, err := s.backend.Load(ctx, key)
+	if err != nil {
+		return rotationSkipped, fmt.Errorf("backend load error: %w", err)
+	}
+	plaintext, err := s.decrypt(key, bs)
+	if err != nil && !isEnvelope(bs) && isPlaintext(bs, err) {
+		// the locks of the `file_system` storage are plaintext by design
+		if policy.action() == actionPlaintext || strings.HasPrefix(key, "locks/") {
+			return rotationSkipped, nil
+		}
+		return rotationPlaintext, nil
+	}
+	if err != nil {
+		return rotationSkipped, err
+	}
+	if r.dryRun {
+		return rotationRotated, nil
+	}
+	if policy.action() == actionPlaintext {
+		return rotationRotated, s.backend.Store(ctx, key, plaintext)
+	}
+	encryptedFile, err := s.encrypt(key, plaintext)
+	if err != nil {
+		return rotationSkipped, err
+	}
+	return rotationRotated, s.backend.Store(ctx, key, encryptedFile)
+}
+
+// loadProgress returns the keys listed in the progress file, if any.
+func (r *rotation) loadProgress() (map[string]bool, error) {
+	done := make(map[string]bool)
+	if r.progressFile == "" {
+		return done, nil
+	}
+	f, err := os.Open(r.progressFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening progress file: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			done[key] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading progress file: %v", err)
+	}
+	return done, nil
+}
@@ -0,0 +1,230 @@
+package encryptedstorage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	retired, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s], "legacy_keys": [%s]}]}`, ageKey(recipient2, ageId2), ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"certificates/a/a.crt", "certificates/a/a.key", "certificates/b/b.crt", "resumed"}
+	for _, k := range keys {
+		if err := retired.Store(ctx, k, []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// plaintext data, e.g. locks, is skipped, and the plaintext data other than locks is reported
+	if err := retired.backend.Store(ctx, "locks/a.lock", []byte(`{"created": "2024-01-01T00:00:00Z"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := retired.backend.Store(ctx, "certificates/c/c.crt", []byte("-----BEGIN CERTIFICATE-----\n")); err != nil {
+		t.Fatal(err)
+	}
+	// data the current keys cannot decrypt fails the rotation of its key
+	unknown, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient3, ageId3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unknown.Store(ctx, "unknown", []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+	progress := filepath.Join(t.TempDir(), "progress")
+	if err := os.WriteFile(progress, []byte("resumed\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func() map[string][]byte {
+		raw := make(map[string][]byte)
+		for _, k := range append(keys, "unknown") {
+			bs, err := rotated.backend.Load(ctx, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw[k] = bs
+		}
+		return raw
+	}
+	before := snapshot()
+
+	dry := &rotation{storage: rotated, dryRun: true, concurrency: 2, progressFile: progress}
+	summary, err := dry.run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(summary.rotated, ","), strings.Join(keys[:3], ","); got != want {
+		t.Errorf("dry run: rotated %s, want %s", got, want)
+	}
+	if got, want := strings.Join(summary.plaintext, ","), "certificates/c/c.crt"; got != want {
+		t.Errorf("dry run: plaintext %s, want %s", got, want)
+	}
+	for k, bs := range snapshot() {
+		if !bytes.Equal(bs, before[k]) {
+			t.Errorf("dry run: %s is rewritten", k)
+		}
+	}
+
+	r := &rotation{storage: rotated, concurrency: 2, progressFile: progress}
+	summary, err = r.run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(summary.rotated, ","), strings.Join(keys[:3], ","); got != want {
+		t.Errorf("rotated %s, want %s", got, want)
+	}
+	if got := strings.Join(summary.resumed, ","); got != "resumed" {
+		t.Errorf("resumed %s, want resumed", got)
+	}
+	if _, ok := summary.failed["unknown"]; !ok || len(summary.failed) != 1 {
+		t.Errorf("failed %v, want only the key of the unknown key", summary.failed)
+	}
+	for _, k := range keys[:3] {
+		if _, err := retired.Load(ctx, k); err == nil {
+			t.Errorf("expected %s to be re-encrypted without the retired key", k)
+		}
+		data, err := rotated.Load(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != val {
+			t.Errorf("%s: data mismatch: %s != %s", k, data, val)
+		}
+	}
+	if _, err := retired.Load(ctx, "resumed"); err != nil {
+		t.Errorf("expected the key listed in the progress file to not be rotated: %v", err)
+	}
+
+	// the rotated keys are recorded, so running again only retries the failed key
+	summary, err = r.run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.rotated) != 0 || len(summary.failed) != 1 {
+		t.Errorf("resumed run: rotated %v, failed %v", summary.rotated, summary.failed)
+	}
+}
+
+func TestLoadStorageFromCaddyfile(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "Caddyfile")
+	caddyfile := fmt.Sprintf(`{
+	storage encrypted {
+		backend file_system {
+			root %s
+		}
+		provider local {
+			key age {
+				recipient %s
+				identity %s
+			}
+		}
+	}
+}
+`, filepath.ToSlash(dir), recipient, ageId)
+	if err := os.WriteFile(config, []byte(caddyfile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, cancel, err := loadStorage(config, "caddyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if err := s.Store(context.Background(), key, []byte(val)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(config, []byte("{\n\tstorage file_system "+filepath.ToSlash(dir)+"\n}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadStorage(config, "caddyfile"); err == nil {
+		t.Error("expected a storage other than 'encrypted' to fail")
+	}
+}
+
+func TestRotationPolicies(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	before, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := provisionStorage(ctx, dir, fmt.Sprintf(`{"encryption": [{"provider": "local", "keys": [%s]}], "policies": [
+		{"paths": ["*.crt"], "action": "plaintext"},
+		{"paths": ["denied/*"], "action": "deny"}
+	]}`, ageKey(recipient, ageId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data stored encrypted before the policies
+	for _, k := range []string{"certificates/a/a.crt", "certificates/a/a.key", "denied/a"} {
+		if err := before.Store(ctx, k, []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pem := []byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n")
+	if err := s.Store(ctx, "certificates/b/b.crt", pem); err != nil {
+		t.Fatal(err)
+	}
+	denied, err := s.backend.Load(ctx, "denied/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := (&rotation{storage: s, concurrency: 2}).run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.failed) != 0 {
+		t.Fatalf("failed: %v", summary.failed)
+	}
+	if got, want := strings.Join(summary.rotated, ","), "certificates/a/a.crt,certificates/a/a.key"; got != want {
+		t.Errorf("rotated %s, want %s", got, want)
+	}
+	for _, k := range []string{"certificates/b/b.crt", "denied/a"} {
+		if !slices.Contains(summary.skipped, k) {
+			t.Errorf("expected %s to be skipped, skipped: %v", k, summary.skipped)
+		}
+	}
+	if len(summary.plaintext) != 0 {
+		t.Errorf("expected the data of the plaintext policy to not be reported: %v", summary.plaintext)
+	}
+	for k, want := range map[string][]byte{
+		// the data of the plaintext policy is decrypted, or kept as-is
+		"certificates/a/a.crt": []byte(val),
+		"certificates/b/b.crt": pem,
+		// the data of the deny policy is left untouched
+		"denied/a": denied,
+	} {
+		raw, err := s.backend.Load(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, want) {
+			t.Errorf("%s: stored data mismatch: %q != %q", k, raw, want)
+		}
+	}
+	data, err := s.Load(ctx, "certificates/a/a.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != val {
+		t.Errorf("data mismatch: %s != %s", data, val)
+	}
+}